@@ -112,3 +112,35 @@ func BenchmarkModelsMarshaller_Marshal(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkModelsMarshaller_MarshalSlice(b *testing.B) {
+	s := make([]*BenchmarkModel, 1000)
+	for i := range s {
+		s[i] = testData()
+	}
+	o := &Options{}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := Marshal(o, s)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkModelsMarshaller_MarshalSliceParallel(b *testing.B) {
+	s := make([]*BenchmarkModel, 1000)
+	for i := range s {
+		s[i] = testData()
+	}
+	o := &Options{Parallelism: 4}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := Marshal(o, s)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package sheriff
+
+import "reflect"
+
+// compactTopLevel prunes the empty values of the marshalled top-level data if options.Compact is set.
+// The top-level object or slice itself is kept, even if it's empty after pruning.
+func compactTopLevel(options *Options, d interface{}) interface{} {
+	if !options.Compact {
+		return d
+	}
+	switch d := d.(type) {
+	case KVStore:
+		return compactKVStore(options, d)
+	case []interface{}:
+		return compactSlice(options, d)
+	}
+	return d
+}
+
+// compactValue recursively prunes the empty values of the marshalled value d.
+// The second return value reports whether d is non-empty and should therefore be kept.
+func compactValue(options *Options, d interface{}) (interface{}, bool) {
+	switch d := d.(type) {
+	case nil:
+		return nil, false
+	case string:
+		return d, d != ""
+	case KVStore:
+		c := compactKVStore(options, d)
+		return c, kvStoreLen(c) > 0
+	case []interface{}:
+		c := compactSlice(options, d)
+		return c, len(c) > 0
+	}
+
+	// values passed through unchanged, e.g. nil pointers or maps and slices using a Marshaller
+	v := reflect.ValueOf(d)
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return d, !v.IsNil()
+	case reflect.Map, reflect.Slice:
+		return d, v.Len() > 0
+	}
+	return d, true
+}
+
+// compactKVStore returns a new KVStore holding the non-empty values of store.
+func compactKVStore(options *Options, store KVStore) KVStore {
+	dest := options.KVStoreFactory()
+	store.Each(func(k string, v interface{}) {
+		if c, ok := compactValue(options, v); ok {
+			dest.Set(k, c)
+		}
+	})
+	return dest
+}
+
+// compactSlice returns the non-empty elements of s.
+func compactSlice(options *Options, s []interface{}) []interface{} {
+	dest := make([]interface{}, 0, len(s))
+	for _, e := range s {
+		if c, ok := compactValue(options, e); ok {
+			dest = append(dest, c)
+		}
+	}
+	return dest
+}
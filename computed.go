@@ -0,0 +1,85 @@
+package sheriff
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/go-version"
+)
+
+// A ComputedField adds a key which isn't backed by a struct field to the output of a struct type,
+// e.g. a derived value like a full name or a URL.
+type ComputedField struct {
+	// Name is the key of the computed value in the output.
+	Name string
+	// Compute returns the value of the field. It receives the marshalled struct value and the options of the call.
+	// The returned value is marshalled like the value of a struct field.
+	Compute func(value interface{}, options *Options) (interface{}, error)
+
+	// Groups restricts the field to the groups like the groups tag of a struct field does.
+	// If this is not set, the field is added independent of the requested groups.
+	Groups []string
+	// Since and Until restrict the field to a range of Options.ApiVersion like the since and until tags do.
+	Since *version.Version
+	Until *version.Version
+}
+
+// include checks whether the field passes the group and version filtering. Compute is only called for included
+// fields, which keeps expensive fields cheap unless they're requested.
+func (c ComputedField) include(options *Options) (bool, error) {
+	fi := fieldInfo{field: reflect.StructField{Name: c.Name}, name: c.Name, since: c.Since, until: c.Until}
+	if len(c.Groups) > 0 {
+		fi.setGroups(strings.Join(c.Groups, ","))
+		if !groupsFilter(options, &fi) {
+			omitField(options, &fi, OmitReasonGroups)
+			return false, nil
+		}
+	}
+	if c.Since != nil || c.Until != nil {
+		include, err := versionFilter(options, &fi)
+		if !include || err != nil {
+			omitField(options, &fi, OmitReasonVersion)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// addComputedFields adds the options.ComputedFields registered for the struct type t to dest.
+//
+// If the name of a computed field equals the key of a marshalled field, including the keys of flattened embedded
+// structs, the marshalled field wins unless options.ComputedOverride is set.
+func addComputedFields(options *Options, t reflect.Type, v reflect.Value, dest KVStore) error {
+	computed := options.ComputedFields[t]
+	if len(computed) == 0 {
+		return nil
+	}
+
+	keys := make(map[string]bool)
+	dest.Each(func(k string, _ interface{}) {
+		keys[k] = true
+	})
+
+	for _, c := range computed {
+		if keys[c.Name] && !options.ComputedOverride || isKeyDenied(options, c.Name) {
+			continue
+		}
+		include, err := c.include(options)
+		if err != nil {
+			return wrapFieldError(err, c.Name)
+		}
+		if !include {
+			continue
+		}
+		d, err := c.Compute(v.Interface(), options)
+		if err != nil {
+			return wrapFieldError(err, c.Name)
+		}
+		if d, err = marshalValue(options, reflect.ValueOf(d)); err != nil {
+			return wrapFieldError(err, c.Name)
+		}
+		dest.Set(c.Name, d)
+		keys[c.Name] = true
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+type ComputedModel struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Name      string `json:"name"`
+}
+
+type ComputedEmbeddingModel struct {
+	ComputedModel
+	ID int `json:"id"`
+}
+
+func computedModelFields(calls *int) map[reflect.Type][]ComputedField {
+	return map[reflect.Type][]ComputedField{
+		reflect.TypeOf(ComputedModel{}): {
+			{
+				Name: "full_name",
+				Compute: func(value interface{}, options *Options) (interface{}, error) {
+					*calls++
+					m := value.(ComputedModel)
+					return m.FirstName + " " + m.LastName, nil
+				},
+			},
+			{
+				Name: "name",
+				Compute: func(value interface{}, options *Options) (interface{}, error) {
+					*calls++
+					return "computed", nil
+				},
+			},
+		},
+		reflect.TypeOf(ComputedEmbeddingModel{}): {
+			{
+				Name: "first_name",
+				Compute: func(value interface{}, options *Options) (interface{}, error) {
+					*calls++
+					return "computed", nil
+				},
+			},
+		},
+	}
+}
+
+func TestMarshal_ComputedFields(t *testing.T) {
+	v := ComputedModel{FirstName: "Alice", LastName: "Smith", Name: "alice"}
+
+	calls := 0
+	actualMap, err := Marshal(&Options{ComputedFields: computedModelFields(&calls)}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	// the real field wins, its computed counterpart isn't called
+	assert.Equal(t, `{"first_name":"Alice","full_name":"Alice Smith","last_name":"Smith","name":"alice"}`, string(actual))
+	assert.Equal(t, 1, calls)
+
+	calls = 0
+	actualMap, err = Marshal(&Options{ComputedFields: computedModelFields(&calls), ComputedOverride: true}, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"first_name":"Alice","full_name":"Alice Smith","last_name":"Smith","name":"computed"}`, string(actual))
+	assert.Equal(t, 2, calls)
+}
+
+func TestMarshal_ComputedFieldsEmbedded(t *testing.T) {
+	v := ComputedEmbeddingModel{ComputedModel: ComputedModel{FirstName: "Alice", LastName: "Smith"}, ID: 1}
+
+	calls := 0
+	actualMap, err := Marshal(&Options{ComputedFields: computedModelFields(&calls)}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	// the keys of the flattened embedded struct count as real fields
+	assert.Equal(t, `{"first_name":"Alice","full_name":"Alice Smith","id":1,"last_name":"Smith","name":""}`, string(actual))
+
+	actualMap, err = Marshal(&Options{ComputedFields: computedModelFields(&calls), ComputedOverride: true}, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"first_name":"computed","full_name":"Alice Smith","id":1,"last_name":"Smith","name":"computed"}`, string(actual))
+}
+
+func TestMarshal_ComputedFieldsError(t *testing.T) {
+	o := &Options{
+		ComputedFields: map[reflect.Type][]ComputedField{
+			reflect.TypeOf(ComputedModel{}): {{
+				Name: "signed_url",
+				Compute: func(value interface{}, options *Options) (interface{}, error) {
+					return nil, errors.New("signing failed")
+				},
+			}},
+		},
+	}
+	_, err := Marshal(o, []ComputedModel{{}})
+	assert.EqualError(t, err, "field [0].signed_url: signing failed")
+}
+
+func TestMarshal_ComputedFieldsLazy(t *testing.T) {
+	calls := 0
+	o := &Options{
+		ComputedFields: map[reflect.Type][]ComputedField{
+			reflect.TypeOf(ComputedModel{}): {{
+				Name:   "signed_url",
+				Groups: []string{"admin"},
+				Since:  version.Must(version.NewVersion("2")),
+				Compute: func(value interface{}, options *Options) (interface{}, error) {
+					calls++
+					return "https://example.com/signed", nil
+				},
+			}},
+		},
+		ApiVersion:      version.Must(version.NewVersion("2")),
+		IncludeEmptyTag: true,
+	}
+	v := ComputedModel{FirstName: "Alice"}
+
+	tests := []struct {
+		groups     []string
+		apiVersion string
+		expected   string
+		calls      int
+	}{
+		{[]string{"api"}, "2", `{"first_name":"Alice","last_name":"","name":""}`, 0},
+		{[]string{"admin"}, "1", `{"first_name":"Alice","last_name":"","name":""}`, 0},
+		{[]string{"admin"}, "2", `{"first_name":"Alice","last_name":"","name":"","signed_url":"https://example.com/signed"}`, 1},
+	}
+
+	for _, test := range tests {
+		calls = 0
+		o.Groups = test.groups
+		o.ApiVersion = version.Must(version.NewVersion(test.apiVersion))
+
+		actualMap, err := Marshal(o, v)
+		assert.NoError(t, err)
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), "groups %v, version %s", test.groups, test.apiVersion)
+		assert.Equal(t, test.calls, calls, "groups %v, version %s", test.groups, test.apiVersion)
+	}
+}
@@ -0,0 +1,59 @@
+package sheriff
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// MarshalCycleError is returned when the data contains a cyclic reference,
+// e.g. a struct holding a pointer to itself. Marshalling it would recurse forever.
+type MarshalCycleError struct {
+	// t is the type at which the cycle has been detected
+	t reflect.Type
+}
+
+func (e MarshalCycleError) Error() string {
+	return fmt.Sprintf("marshaller: cyclic reference detected at type %s", e.t)
+}
+
+// visitKey identifies a value which is currently being marshalled.
+// The type is part of the key, as e.g. a struct and its first field share the same address.
+type visitKey struct {
+	ptr uintptr
+	t   reflect.Type
+	len int
+}
+
+// visitStackSize is the number of nested values tracked without allocating, deeper values are tracked in a map.
+const visitStackSize = 4
+
+// enter marks the value as being marshalled. It returns a MarshalCycleError if the value is already being
+// marshalled further up in the tree. Every successful enter has to be followed by a leave.
+func (s *marshalState) enter(key visitKey) error {
+	for i := 0; i < s.depth && i < visitStackSize; i++ {
+		if s.visitStack[i] == key {
+			return MarshalCycleError{t: key.t}
+		}
+	}
+	if s.visiting[key] {
+		return MarshalCycleError{t: key.t}
+	}
+	if s.depth < visitStackSize {
+		s.visitStack[s.depth] = key
+	} else {
+		if s.visiting == nil {
+			s.visiting = make(map[visitKey]bool)
+		}
+		s.visiting[key] = true
+	}
+	s.depth++
+	return nil
+}
+
+// leave marks the value as done.
+func (s *marshalState) leave(key visitKey) {
+	s.depth--
+	if s.depth >= visitStackSize {
+		delete(s.visiting, key)
+	}
+}
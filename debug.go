@@ -0,0 +1,112 @@
+package sheriff
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The reasons reported by MarshalDebug for omitted fields.
+const (
+	// OmitReasonTag is reported for fields excluded using `json:"-"` or `sheriff:"-"`.
+	OmitReasonTag = "tag"
+	// OmitReasonOmitEmpty is reported for empty fields tagged with omitempty.
+	OmitReasonOmitEmpty = "omitempty"
+	// OmitReasonOmitEmptyGroups is reported for empty fields omitted by the `omitempty_groups` tag.
+	OmitReasonOmitEmptyGroups = "omitempty_groups"
+	// OmitReasonOmitDefaults is reported for zero fields omitted by Options.OmitDefaults.
+	OmitReasonOmitDefaults = "omit_defaults"
+	// OmitReasonGroups is reported for fields not matching the requested or denied groups.
+	OmitReasonGroups = "groups"
+	// OmitReasonVersion is reported for fields excluded by the since, until or version tags.
+	OmitReasonVersion = "version"
+	// OmitReasonFilter is reported for fields excluded by a custom field filter.
+	OmitReasonFilter = "filter"
+	// OmitReasonDeniedKey is reported for keys stripped by Options.GroupKeyDeny.
+	OmitReasonDeniedKey = "denied_key"
+	// OmitReasonEmptyNested is reported for nested objects which are empty after filtering, see Options.OmitEmptyNested.
+	OmitReasonEmptyNested = "empty_nested"
+)
+
+// MarshalDebug is like Marshal but additionally returns the omitted fields, mapping the path of every field which
+// isn't part of the output to the reason, see the OmitReason constants. The paths use the same format as
+// MarshalFieldError, e.g. "addresses[2].street".
+//
+// MarshalDebug is meant for finding out why a field disappears during development, Marshal doesn't track the omitted
+// fields. Top-level slices are always marshalled sequentially.
+func MarshalDebug(options *Options, data interface{}) (interface{}, map[string]string, error) {
+	c := *options
+	c.Parallelism = 0
+	c.omitted = make(map[string]string)
+	d, err := Marshal(&c, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return d, c.omitted, nil
+}
+
+// debugInfo tracks the omitted fields of a MarshalDebug call.
+type debugInfo struct {
+	// path holds the segments of the value currently being marshalled
+	path    []string
+	omitted map[string]string
+}
+
+// enterPath appends the segment, e.g. a key or "[1]", to the path of the value being marshalled.
+// Every enterPath has to be followed by a leavePath.
+func (s *marshalState) enterPath(segment string) {
+	if s.debug != nil {
+		s.debug.path = append(s.debug.path, segment)
+	}
+}
+
+// enterIndex appends the index of a slice element to the path of the value being marshalled.
+func (s *marshalState) enterIndex(i int) {
+	if s.debug != nil {
+		s.enterPath("[" + strconv.Itoa(i) + "]")
+	}
+}
+
+// leavePath removes the last segment from the path of the value being marshalled.
+func (s *marshalState) leavePath() {
+	if s.debug != nil {
+		s.debug.path = s.debug.path[:len(s.debug.path)-1]
+	}
+}
+
+// omit records the field of the value being marshalled as omitted for the reason.
+func (s *marshalState) omit(name string, reason string) {
+	if s.debug == nil {
+		return
+	}
+	var b strings.Builder
+	for _, segment := range append(s.debug.path, name) {
+		if b.Len() > 0 && !strings.HasPrefix(segment, "[") {
+			b.WriteByte('.')
+		}
+		b.WriteString(segment)
+	}
+	s.debug.omitted[b.String()] = reason
+}
+
+// omitField records the field as omitted for the reason.
+func omitField(options *Options, fi *fieldInfo, reason string) {
+	if options.state.debug == nil {
+		return
+	}
+	name := fi.key(options)
+	if name == "-" {
+		name = fi.field.Name
+	}
+	options.state.omit(name, reason)
+}
+
+// filterReason determines why the field has been excluded by the filter.
+func filterReason(options *Options, fi *fieldInfo) string {
+	if options.FieldFilter != nil || options.ContextFieldFilter != nil || options.ValueFieldFilter != nil {
+		return OmitReasonFilter
+	}
+	if !groupsFilter(options, fi) {
+		return OmitReasonGroups
+	}
+	return OmitReasonVersion
+}
@@ -0,0 +1,83 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+type DebugAddress struct {
+	Street string `json:"street" groups:"api"`
+	Notes  string `json:"notes" groups:"admin"`
+}
+
+type DebugModel struct {
+	Username  string                  `json:"username" groups:"api"`
+	Password  string                  `json:"-"`
+	Internal  string                  `json:"internal" sheriff:"-"`
+	Nickname  string                  `json:"nickname,omitempty" groups:"api"`
+	Bio       string                  `json:"bio" groups:"api" omitempty_groups:"api"`
+	Email     string                  `json:"email" groups:"admin"`
+	Legacy    string                  `json:"legacy" groups:"api" until:"1"`
+	Addresses []DebugAddress          `json:"addresses" groups:"api"`
+	ByName    map[string]DebugAddress `json:"by_name" groups:"api"`
+	Secret    string                  `json:"secret_internal" groups:"api"`
+}
+
+func TestMarshalDebug(t *testing.T) {
+	v := DebugModel{
+		Username:  "alice",
+		Password:  "secret",
+		Internal:  "internal",
+		Email:     "alice@example.com",
+		Legacy:    "legacy",
+		Addresses: []DebugAddress{{Street: "Main"}, {Street: "Second"}},
+		ByName:    map[string]DebugAddress{"home": {Street: "Main"}},
+		Secret:    "secret",
+	}
+	o := &Options{
+		Groups:       []string{"api"},
+		ApiVersion:   version.Must(version.NewVersion("2")),
+		GroupKeyDeny: map[string][]string{"api": {"*_internal"}},
+	}
+
+	actualMap, omitted, err := MarshalDebug(o, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	expectedMap, err := Marshal(o, v)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(expectedMap)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+
+	assert.Equal(t, map[string]string{
+		"Password":           OmitReasonTag,
+		"internal":           OmitReasonTag,
+		"nickname":           OmitReasonOmitEmpty,
+		"bio":                OmitReasonOmitEmptyGroups,
+		"email":              OmitReasonGroups,
+		"legacy":             OmitReasonVersion,
+		"addresses[0].notes": OmitReasonGroups,
+		"addresses[1].notes": OmitReasonGroups,
+		"by_name.home.notes": OmitReasonGroups,
+		"secret_internal":    OmitReasonDeniedKey,
+	}, omitted)
+}
+
+func TestMarshalDebug_Filter(t *testing.T) {
+	o := &Options{
+		OmitDefaults: true,
+		FieldFilter: func(field reflect.StructField) (bool, error) {
+			return field.Name != "Email", nil
+		},
+	}
+	_, omitted, err := MarshalDebug(o, DebugModel{Username: "alice", Email: "alice@example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, OmitReasonFilter, omitted["email"])
+	assert.Equal(t, OmitReasonOmitDefaults, omitted["bio"])
+}
@@ -0,0 +1,46 @@
+package sheriff
+
+import (
+	"reflect"
+	"strings"
+)
+
+// MarshalWithFieldGroups is like Marshal but takes the groups of struct fields from fieldGroups, which allows
+// configuring the visibility at runtime, e.g. from a mapping file, without changing the models.
+//
+// The outer map is keyed by the name of the struct type as returned by reflect.Type.Name, e.g. "User", the inner
+// map by the Go name of the field. The listed groups replace the groups tag of the field, an empty list removes
+// them. Fields which are not part of the map keep the groups of their tag.
+func MarshalWithFieldGroups(options *Options, data interface{}, fieldGroups map[string]map[string][]string) (interface{}, error) {
+	c := *options
+	c.fieldGroups = fieldGroups
+	return Marshal(&c, data)
+}
+
+// typeInfoOf returns the typeInfo of the struct type t, taking the groups passed to MarshalWithFieldGroups
+// into account. Types with overridden groups are cached for the duration of the call.
+func typeInfoOf(options *Options, t reflect.Type) *typeInfo {
+	ti := cachedTypeInfo(t, options.state.tagNames)
+	groups, ok := options.fieldGroups[t.Name()]
+	if !ok {
+		return ti
+	}
+	if overridden, ok := options.state.fieldGroupTypes[t]; ok {
+		return overridden
+	}
+
+	overridden := &typeInfo{fields: make([]fieldInfo, len(ti.fields))}
+	copy(overridden.fields, ti.fields)
+	for i := range overridden.fields {
+		fi := &overridden.fields[i]
+		if g, ok := groups[fi.field.Name]; ok {
+			fi.setGroups(strings.Join(g, ","))
+		}
+	}
+
+	if options.state.fieldGroupTypes == nil {
+		options.state.fieldGroupTypes = make(map[reflect.Type]*typeInfo)
+	}
+	options.state.fieldGroupTypes[t] = overridden
+	return overridden
+}
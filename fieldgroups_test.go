@@ -0,0 +1,52 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type FieldGroupsAddress struct {
+	City   string `json:"city" groups:"public"`
+	Street string `json:"street" groups:"private"`
+}
+
+type FieldGroupsUser struct {
+	Username string              `json:"username" groups:"public"`
+	Email    string              `json:"email" groups:"private"`
+	Phone    string              `json:"phone" groups:"public"`
+	Address  *FieldGroupsAddress `json:"address" groups:"public"`
+	Notes    string              `json:"notes"`
+}
+
+func TestMarshalWithFieldGroups(t *testing.T) {
+	v := FieldGroupsUser{
+		Username: "alice",
+		Email:    "alice@example.com",
+		Phone:    "123",
+		Address:  &FieldGroupsAddress{City: "Zurich", Street: "Main Street"},
+		Notes:    "notes",
+	}
+	// e.g. loaded from a JSON or YAML mapping file
+	var fieldGroups map[string]map[string][]string
+	err := json.Unmarshal([]byte(`{
+		"FieldGroupsUser": {"Email": ["public", "private"], "Phone": [], "Notes": ["public"]},
+		"FieldGroupsAddress": {"Street": ["public"]}
+	}`), &fieldGroups)
+	assert.NoError(t, err)
+
+	o := &Options{Groups: []string{"public"}}
+	actualMap, err := MarshalWithFieldGroups(o, v, fieldGroups)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"address":{"city":"Zurich","street":"Main Street"},"email":"alice@example.com","notes":"notes","username":"alice"}`, string(actual))
+
+	// the tags are used again without the mapping
+	actualMap, err = Marshal(o, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"address":{"city":"Zurich"},"phone":"123","username":"alice"}`, string(actual))
+}
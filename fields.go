@@ -0,0 +1,284 @@
+package sheriff
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-version"
+)
+
+// fieldInfo holds the precomputed tag information of a struct field.
+type fieldInfo struct {
+	field reflect.StructField
+
+	// name is the output key, which is the json name or the field name if there's none.
+	name string
+	// hasJSONName is true if the json tag specifies a name.
+	hasJSONName bool
+	// skip is true if the field is excluded by `json:"-"` or `sheriff:"-"`.
+	skip      bool
+	omitEmpty bool
+	quoted    bool
+	// quotedErr is set if the string option is used on a type implementing a marshaler, e.g. time.Time.
+	quotedErr error
+
+	// hasGroups is true if the field has a non-empty groups tag.
+	hasGroups     bool
+	groups        []string
+	negatedGroups []string
+	minGroups     int
+	// parentGroups are the split groups tag, propagated to the fields of an embedded struct.
+	parentGroups []string
+	// inheritGroups is set by the inherit option of the groups tag, see Options.InheritFieldGroups.
+	inheritGroups   bool
+	omitEmptyGroups []string
+
+	since    *version.Version
+	sinceErr error
+	until    *version.Version
+	untilErr error
+	// constraint is the parsed `version` tag, it takes precedence over since and until.
+	constraint    version.Constraints
+	constraintErr error
+
+	// defaultGroups are the literal values of the `default_groups` tag per group.
+	defaultGroups []groupValue
+	// renames are the keys of the `rename` tag per group.
+	renames []groupValue
+
+	// redact is true if the field is tagged with `redact:"true"`.
+	redact bool
+
+	// via is the name of the parent's method marshalling the field.
+	via string
+
+	rawJSON     bool
+	timeFormat  string
+	maxItems    int
+	hasMaxItems bool
+	maxItemsErr error
+}
+
+// groupValue is a value of a tag which applies to a single group, e.g. `default_groups:"public=redacted"`.
+type groupValue struct {
+	group string
+	value string
+}
+
+// parseGroupValues parses a comma-separated list of group and value pairs separated by sep.
+func parseGroupValues(tag, sep string) []groupValue {
+	if tag == "" {
+		return nil
+	}
+	var values []groupValue
+	for _, entry := range strings.Split(tag, ",") {
+		group, value, _ := strings.Cut(entry, sep)
+		values = append(values, groupValue{group: group, value: value})
+	}
+	return values
+}
+
+// matchGroupValue returns the value of the first of the pairs whose group is requested.
+func matchGroupValue(values []groupValue, groups []string, fold bool) (string, bool) {
+	for _, v := range values {
+		if containsGroup(v.group, groups, fold) {
+			return v.value, true
+		}
+	}
+	return "", false
+}
+
+// groupDefaultValue returns the literal of the `default_groups` tag for the first of its groups which is requested.
+func (fi *fieldInfo) groupDefaultValue(options *Options) (string, bool) {
+	return matchGroupValue(fi.defaultGroups, options.Groups, options.CaseInsensitiveGroups)
+}
+
+// key returns the output key of the field, which is renamed by the `rename` tag if one of its groups is requested.
+// If several groups match, the first of the requested groups wins, or the first rule of the tag with
+// NameResolutionTagOrder.
+func (fi *fieldInfo) key(options *Options) string {
+	if len(fi.renames) == 0 {
+		return fi.defaultKey(options)
+	}
+	fold := options.CaseInsensitiveGroups
+	if options.NameResolution == NameResolutionTagOrder {
+		if name, ok := matchGroupValue(fi.renames, options.Groups, fold); ok {
+			return name
+		}
+		return fi.defaultKey(options)
+	}
+	for _, group := range options.Groups {
+		for _, rename := range fi.renames {
+			if rename.group == group || fold && strings.EqualFold(rename.group, group) {
+				return rename.value
+			}
+		}
+	}
+	return fi.defaultKey(options)
+}
+
+// defaultKey returns the json name of the field, or its Go name converted by options.KeyNamingStrategy.
+func (fi *fieldInfo) defaultKey(options *Options) string {
+	if fi.hasJSONName || fi.skip || options.KeyNamingStrategy == "" {
+		return fi.name
+	}
+	return applyKeyNaming(options.KeyNamingStrategy, fi.name)
+}
+
+// inheritGroupsOption is the option of the groups tag making the untagged fields of the value inherit the groups,
+// e.g. `groups:"api,inherit"`.
+const inheritGroupsOption = "inherit"
+
+// setGroups parses the comma separated groups of the field, replacing the previous ones.
+func (fi *fieldInfo) setGroups(groups string) {
+	fi.parentGroups = strings.Split(groups, ",")
+	fi.inheritGroups = false
+	for i, group := range fi.parentGroups {
+		if group == inheritGroupsOption {
+			fi.inheritGroups = true
+			fi.parentGroups = append(fi.parentGroups[:i:i], fi.parentGroups[i+1:]...)
+			groups = strings.Join(fi.parentGroups, ",")
+			break
+		}
+	}
+	fi.hasGroups = groups != ""
+	fi.groups, fi.minGroups, fi.negatedGroups = nil, 0, nil
+	if fi.hasGroups {
+		fi.groups, fi.minGroups = parseGroupsModifier(fi.parentGroups)
+		fi.groups, fi.negatedGroups = splitNegatedGroups(fi.groups)
+	}
+}
+
+// implementsMarshaler checks whether values of type t marshal themselves using json.Marshaler or
+// encoding.TextMarshaler, on their value or on their pointer.
+func implementsMarshaler(t reflect.Type) bool {
+	for _, t := range []reflect.Type{t, reflect.PointerTo(t)} {
+		if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	marshallerType      = reflect.TypeOf((*Marshaller)(nil)).Elem()
+	stringerType        = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	jsonNumberType      = reflect.TypeOf(json.Number(""))
+)
+
+// typeInfo holds the precomputed field information of a struct type.
+type typeInfo struct {
+	fields []fieldInfo
+}
+
+// tagNames are the names of the configurable tags, see Options.TagName, Options.GroupName, Options.SinceName and
+// Options.UntilName.
+type tagNames struct {
+	key    string
+	groups string
+	since  string
+	until  string
+}
+
+// typeInfoKey identifies a cached typeInfo, the same type results in different field information per tag names.
+type typeInfoKey struct {
+	t     reflect.Type
+	names tagNames
+}
+
+// typeInfoCache caches the typeInfo per reflect.Type and tag names.
+var typeInfoCache sync.Map // map[typeInfoKey]*typeInfo
+
+// cachedTypeInfo returns the typeInfo of the struct type t, computing it on first use.
+func cachedTypeInfo(t reflect.Type, names tagNames) *typeInfo {
+	key := typeInfoKey{t: t, names: names}
+	if ti, ok := typeInfoCache.Load(key); ok {
+		return ti.(*typeInfo)
+	}
+
+	ti := &typeInfo{fields: make([]fieldInfo, t.NumField())}
+	for i := 0; i < t.NumField(); i++ {
+		ti.fields[i] = newFieldInfo(t.Field(i), names)
+	}
+
+	actual, _ := typeInfoCache.LoadOrStore(key, ti)
+	return actual.(*typeInfo)
+}
+
+// newFieldInfo parses the tags of the passed field.
+func newFieldInfo(field reflect.StructField, names tagNames) fieldInfo {
+	fi := fieldInfo{field: field}
+
+	jsonTag, jsonOpts := parseTag(field.Tag.Get(names.key))
+	// Only embedded fields without an explicit json name are flattened,
+	// a tag with options only (e.g. `json:",omitempty"`) still flattens.
+	fi.hasJSONName = jsonTag != ""
+	fi.name = jsonTag
+	// If no json tag is provided, use the field Name
+	if fi.name == "" {
+		fi.name = field.Name
+	}
+	// sheriff:"-" excludes the field from sheriff only, leaving the json tag intact
+	fi.skip = fi.name == "-" || field.Tag.Get("sheriff") == "-"
+	fi.omitEmpty = jsonOpts.Contains("omitempty")
+
+	// like encoding/json, the string option only applies to scalars and unnamed pointers to them
+	if jsonOpts.Contains("string") {
+		ft := field.Type
+		if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch ft.Kind() {
+		case reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64,
+			reflect.String:
+			fi.quoted = true
+		default:
+			// encoding/json ignores the option for these as well, which surprises as they are marshalled as strings
+			if implementsMarshaler(ft) {
+				fi.quotedErr = fmt.Errorf("marshaller: the string option is not supported for type %s", field.Type)
+			}
+		}
+	}
+
+	fi.setGroups(field.Tag.Get(names.groups))
+	if omitEmptyGroups := field.Tag.Get("omitempty_groups"); omitEmptyGroups != "" {
+		fi.omitEmptyGroups = strings.Split(omitEmptyGroups, ",")
+	}
+
+	if since := field.Tag.Get(names.since); since != "" {
+		fi.since, fi.sinceErr = version.NewVersion(since)
+	}
+	if until := field.Tag.Get(names.until); until != "" {
+		fi.until, fi.untilErr = version.NewVersion(until)
+	}
+	if constraint := field.Tag.Get("version"); constraint != "" {
+		fi.constraint, fi.constraintErr = version.NewConstraint(constraint)
+	}
+
+	fi.defaultGroups = parseGroupValues(field.Tag.Get("default_groups"), "=")
+	fi.renames = parseGroupValues(field.Tag.Get("rename"), ":")
+	fi.redact = field.Tag.Get("redact") == "true"
+	fi.via = field.Tag.Get("via")
+	fi.rawJSON = field.Tag.Get("rawjson") == "true"
+	fi.timeFormat = field.Tag.Get("timeformat")
+	if maxItems := field.Tag.Get("maxitems"); maxItems != "" {
+		fi.hasMaxItems = true
+		var err error
+		if fi.maxItems, err = strconv.Atoi(maxItems); err != nil {
+			fi.maxItemsErr = fmt.Errorf("marshaller: invalid maxitems tag: %w", err)
+		}
+	}
+
+	return fi
+}
@@ -0,0 +1,117 @@
+package sheriff
+
+import (
+	"strconv"
+	"strings"
+)
+
+// minGroupsPrefix is the prefix of the modifier requiring a minimum number of matching groups, e.g. `groups:"min2:a,b,c"`.
+const minGroupsPrefix = "min"
+
+// parseGroupsModifier extracts the minimum count modifier from the first element of a split groups tag.
+// It returns the groups without the modifier and the minimum number of groups which have to match,
+// which is 1 if no modifier is specified.
+func parseGroupsModifier(groups []string) ([]string, int) {
+	if len(groups) == 0 || !strings.HasPrefix(groups[0], minGroupsPrefix) {
+		return groups, 1
+	}
+	modifier, first, ok := strings.Cut(groups[0], ":")
+	if !ok {
+		return groups, 1
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(modifier, minGroupsPrefix))
+	if err != nil || n < 1 {
+		return groups, 1
+	}
+
+	parsed := make([]string, len(groups))
+	copy(parsed, groups)
+	parsed[0] = first
+	return parsed, n
+}
+
+// wildcardGroup is the group matching every field having at least one group.
+const wildcardGroup = "*"
+
+// negatedGroupPrefix marks a group which excludes the field if it is requested, e.g. `groups:"api,!internal"`.
+const negatedGroupPrefix = "!"
+
+// splitNegatedGroups splits the groups into the positive groups and the negated groups without their prefix.
+func splitNegatedGroups(groups []string) ([]string, []string) {
+	var positive, negated []string
+	for _, group := range groups {
+		if strings.HasPrefix(group, negatedGroupPrefix) {
+			negated = append(negated, strings.TrimPrefix(group, negatedGroupPrefix))
+		} else {
+			positive = append(positive, group)
+		}
+	}
+	return positive, negated
+}
+
+// countContains returns the number of strings in `a` which are contained in `b`, ignoring the case if fold is set.
+func countContains(a []string, b []string, fold bool) int {
+	n := 0
+	for _, key := range a {
+		if containsGroup(key, b, fold) {
+			n++
+		}
+	}
+	return n
+}
+
+// containsAll checks whether every string of `b`, except for the wildcard group, is contained in `a`,
+// ignoring the case if fold is set.
+func containsAll(a []string, b []string, fold bool) bool {
+	for _, key := range b {
+		if key != wildcardGroup && !containsGroup(key, a, fold) {
+			return false
+		}
+	}
+	return true
+}
+
+// expandGroupAliases replaces the aliases of options.GroupAliases in groups by the groups they stand for,
+// recursively. The aliases themselves are kept, so fields tagged with an alias still match. Every group is
+// expanded at most once, which protects against cyclic aliases. The aliases are looked up ignoring the case
+// if fold is set.
+func expandGroupAliases(groups []string, aliases map[string][]string, fold bool) []string {
+	if len(aliases) == 0 {
+		return groups
+	}
+
+	var expanded []string
+	seen := make(map[string]bool)
+	var expand func(groups []string)
+	expand = func(groups []string) {
+		for _, group := range groups {
+			key := group
+			if fold {
+				key = strings.ToLower(group)
+			}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			expanded = append(expanded, group)
+			expand(groupEntries(aliases, group, fold))
+		}
+	}
+	expand(groups)
+	return expanded
+}
+
+// groupEntries returns the entries of a map keyed by group, e.g. options.GroupKeyDeny, for the group.
+// If fold is set the entries of all keys matching the group ignoring the case are returned.
+func groupEntries(entries map[string][]string, group string, fold bool) []string {
+	if !fold {
+		return entries[group]
+	}
+	var matched []string
+	for key, values := range entries {
+		if strings.EqualFold(key, group) {
+			matched = append(matched, values...)
+		}
+	}
+	return matched
+}
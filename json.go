@@ -0,0 +1,33 @@
+package sheriff
+
+import "encoding/json"
+
+// MarshalToJSON marshals the passed data using Marshal and encodes the result using json.Marshal.
+// Errors of both steps are returned.
+func MarshalToJSON(options *Options, data interface{}) ([]byte, error) {
+	v, err := Marshal(options, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// MarshalToJSONIndent is like MarshalToJSON but applies json.MarshalIndent to format the output.
+func MarshalToJSONIndent(options *Options, data interface{}, prefix, indent string) ([]byte, error) {
+	v, err := Marshal(options, data)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(v, prefix, indent)
+}
+
+// MarshalIndent is like MarshalToJSONIndent but produces a deterministic output, e.g. for golden file tests:
+// the keys of structs are in declaration order, the keys of maps are sorted according to Options.MapKeySort.
+// The options are not modified, the NewOrderedKVStore is used unless Options.KVStoreFactory is set.
+func MarshalIndent(options *Options, data interface{}, prefix, indent string) ([]byte, error) {
+	c := *options
+	if c.KVStoreFactory == nil {
+		c.KVStoreFactory = NewOrderedKVStore
+	}
+	return MarshalToJSONIndent(&c, data, prefix, indent)
+}
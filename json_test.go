@@ -0,0 +1,77 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalToJSON(t *testing.T) {
+	v := AModel{AllGroups: true, TestGroup: true}
+
+	d, err := MarshalToJSON(&Options{Groups: []string{"test"}}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"something":true}`, string(d))
+
+	d, err = MarshalToJSONIndent(&Options{Groups: []string{"test"}}, v, "", "  ")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\n  \"something\": true\n}", string(d))
+}
+
+func TestMarshalToJSON_Errors(t *testing.T) {
+	// error of the sheriff step
+	_, err := MarshalToJSON(&Options{}, map[AModel]string{{}: "a"})
+	assert.Error(t, err)
+	_, err = MarshalToJSONIndent(&Options{}, map[AModel]string{{}: "a"}, "", "  ")
+	assert.Error(t, err)
+
+	// error of the json step
+	o := &Options{
+		NumberFormatter: func(kind reflect.Kind, value interface{}) (interface{}, error) {
+			return make(chan int), nil
+		},
+	}
+	_, err = MarshalToJSON(o, 1)
+	var jsonErr *json.UnsupportedTypeError
+	assert.True(t, errors.As(err, &jsonErr))
+}
+
+func TestMarshalIndent(t *testing.T) {
+	type indentModel struct {
+		Zeta   string            `json:"zeta"`
+		Alpha  int               `json:"alpha"`
+		Labels map[string]string `json:"labels"`
+		Nested []AModel          `json:"nested"`
+	}
+	v := indentModel{
+		Zeta:   "z",
+		Alpha:  1,
+		Labels: map[string]string{"b": "2", "a": "1", "c": "3"},
+		Nested: []AModel{{AllGroups: true, TestGroup: true}},
+	}
+	o := &Options{Groups: []string{"test"}, IncludeEmptyTag: true}
+
+	expected := `{
+  "zeta": "z",
+  "alpha": 1,
+  "labels": {
+    "a": "1",
+    "b": "2",
+    "c": "3"
+  },
+  "nested": [
+    {
+      "something": true
+    }
+  ]
+}`
+	for i := 0; i < 100; i++ {
+		d, err := MarshalIndent(o, v, "", "  ")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(d))
+	}
+	assert.Nil(t, o.KVStoreFactory)
+}
@@ -1,5 +1,10 @@
 package sheriff
 
+import (
+	"bytes"
+	"encoding/json"
+)
+
 // kvStore is the default implementation of the KVStore interface that sheriff converts a struct into.
 // It is the fastest option, but does result in a re-ordering of the final JSON properties.
 type kvStore map[string]interface{}
@@ -15,3 +20,92 @@ func (m kvStore) Each(f func(k string, v interface{})) {
 		f(k, v)
 	}
 }
+
+// kvStoreLen returns the number of elements in the passed KVStore.
+func kvStoreLen(s KVStore) int {
+	n := 0
+	s.Each(func(string, interface{}) {
+		n++
+	})
+	return n
+}
+
+// kvStoreHas checks whether the key is set in the passed KVStore.
+func kvStoreHas(s KVStore, key string) bool {
+	found := false
+	s.Each(func(k string, _ interface{}) {
+		if k == key {
+			found = true
+		}
+	})
+	return found
+}
+
+// kvPair is a single key-value pair of an orderedKVStore.
+type kvPair struct {
+	key   string
+	value interface{}
+}
+
+// orderedKVStore is a KVStore keeping the insertion order of its keys, which results in the JSON properties
+// being in struct declaration order. Setting an existing key replaces its value in place.
+type orderedKVStore struct {
+	pairs []kvPair
+}
+
+// NewOrderedKVStore returns an empty KVStore keeping the insertion order of its keys.
+// It can be used as Options.KVStoreFactory in order to get a deterministic output.
+func NewOrderedKVStore() KVStore {
+	return &orderedKVStore{}
+}
+
+// Set inserts the value at the given key, keeping the position of an already existing key.
+func (s *orderedKVStore) Set(k string, v interface{}) {
+	for i := range s.pairs {
+		if s.pairs[i].key == k {
+			s.pairs[i].value = v
+			return
+		}
+	}
+	s.pairs = append(s.pairs, kvPair{key: k, value: v})
+}
+
+// Each applies the callback function to each element in insertion order.
+func (s *orderedKVStore) Each(f func(k string, v interface{})) {
+	for _, p := range s.pairs {
+		f(p.key, p.value)
+	}
+}
+
+// Keys returns the keys in insertion order.
+func (s *orderedKVStore) Keys() []string {
+	keys := make([]string, len(s.pairs))
+	for i, p := range s.pairs {
+		keys[i] = p.key
+	}
+	return keys
+}
+
+// MarshalJSON encodes the store as a JSON object, keeping the insertion order of the keys.
+func (s *orderedKVStore) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, p := range s.pairs {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(p.key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(p.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
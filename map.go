@@ -0,0 +1,189 @@
+package sheriff
+
+import (
+	"encoding"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// mapEntry is a key and its value of a map.
+type mapEntry struct {
+	key   reflect.Value
+	value reflect.Value
+}
+
+// marshalMap marshals the non-nil map v into a KVStore, or into a slice of entries if options.MapsAsEntries is set.
+// Like with encoding/json, an empty map results in an empty object, unless the field is tagged with omitempty,
+// which removes the key before the map is marshalled.
+func marshalMap(options *Options, v reflect.Value) (interface{}, error) {
+	mapKeys := v.MapKeys()
+	if len(mapKeys) == 0 {
+		// non-nil empty maps result in an empty object, nil maps have been returned as nil above
+		if options.MapsAsEntries {
+			return []interface{}{}, nil
+		}
+		return options.KVStoreFactory(), nil
+	}
+	visit := visitKey{ptr: v.Pointer(), t: v.Type()}
+	if err := options.state.enter(visit); err != nil {
+		return nil, err
+	}
+	defer options.state.leave(visit)
+
+	keys := make([]string, len(mapKeys))
+	entries := make(map[string]mapEntry, len(mapKeys))
+	var originals map[string]string
+	if options.MapKeyTransformer != nil {
+		originals = make(map[string]string, len(mapKeys))
+	}
+	for i, key := range mapKeys {
+		name, err := resolveKeyName(key)
+		if err != nil {
+			return nil, err
+		}
+		if originals != nil {
+			original := name
+			name = options.MapKeyTransformer(name)
+			if other, ok := originals[name]; ok {
+				return nil, fmt.Errorf("%w: %q and %q are both transformed to %q in %s", ErrDuplicateMapKey, other, original, name, v.Type())
+			}
+			originals[name] = original
+		}
+		if _, ok := entries[name]; ok {
+			return nil, fmt.Errorf("%w: %q in %s", ErrDuplicateMapKey, name, v.Type())
+		}
+		keys[i] = name
+		entries[name] = mapEntry{key: key, value: v.MapIndex(key)}
+	}
+
+	// maps exposing their keys in a specific order are marshalled in that order,
+	// all others are sorted in order to get a deterministic order
+	if err := sortMapKeys(options.MapKeySort, keys); err != nil {
+		return nil, err
+	}
+	if orderer, ok := v.Interface().(keysOrderer); ok {
+		keys = orderer.Keys()
+		if options.MapKeyTransformer != nil {
+			transformed := make([]string, len(keys))
+			for i, key := range keys {
+				transformed[i] = options.MapKeyTransformer(key)
+			}
+			keys = transformed
+		}
+	}
+
+	if options.MapsAsEntries {
+		return marshalMapEntries(options, keys, entries)
+	}
+
+	dest := options.KVStoreFactory()
+	for _, key := range keys {
+		entry, ok := entries[key]
+		if !ok {
+			// key returned by Keys() which is not part of the map
+			continue
+		}
+		if isKeyDenied(options, key) {
+			options.state.omit(key, OmitReasonDeniedKey)
+			continue
+		}
+		options.state.enterPath(key)
+		d, err := marshalElement(options, entry.value)
+		options.state.leavePath()
+		if err != nil {
+			return nil, wrapFieldError(err, key)
+		}
+		dest.Set(key, d)
+	}
+	if err := checkMaxFields(options, dest); err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+// sortMapKeys sorts the keys according to the passed Options.MapKeySort.
+func sortMapKeys(order string, keys []string) error {
+	switch order {
+	case "", MapKeySortLexical:
+		// same order as encoding/json
+		sort.Strings(keys)
+	case MapKeySortStableHash:
+		hashes := make(map[string]uint64, len(keys))
+		for _, key := range keys {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			hashes[key] = h.Sum64()
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			hi, hj := hashes[keys[i]], hashes[keys[j]]
+			if hi != hj {
+				return hi < hj
+			}
+			return keys[i] < keys[j]
+		})
+	default:
+		return fmt.Errorf("marshaller: unknown MapKeySort %q", order)
+	}
+	return nil
+}
+
+// marshalMapEntries marshals the map as a slice of {"key": k, "value": v} objects in the order of keys.
+// The keys are marshalled like any other value, which keeps e.g. integer keys integers.
+func marshalMapEntries(options *Options, keys []string, entries map[string]mapEntry) (interface{}, error) {
+	dest := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		entry, ok := entries[key]
+		if !ok {
+			// key returned by Keys() which is not part of the map
+			continue
+		}
+		if isKeyDenied(options, key) {
+			options.state.omit(key, OmitReasonDeniedKey)
+			continue
+		}
+		k, err := marshalValue(options, entry.key)
+		if err != nil {
+			return nil, err
+		}
+		options.state.enterPath(key)
+		d, err := marshalElement(options, entry.value)
+		options.state.leavePath()
+		if err != nil {
+			return nil, wrapFieldError(err, key)
+		}
+		e := options.KVStoreFactory()
+		e.Set("key", k)
+		e.Set("value", d)
+		dest = append(dest, e)
+	}
+	return dest, nil
+}
+
+// resolveKeyName converts a map key to its string form like encoding/json does: string keys are used as they are,
+// keys implementing encoding.TextMarshaler are marshalled and integer keys are formatted in base 10.
+// Other keys are supported if they implement fmt.Stringer.
+func resolveKeyName(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		buf, err := tm.MarshalText()
+		return string(buf), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	if s, ok := k.Interface().(fmt.Stringer); ok {
+		return s.String(), nil
+	}
+	return "", MarshalInvalidTypeError{t: k.Kind(), data: k.Interface(), mapKey: true}
+}
@@ -0,0 +1,88 @@
+package sheriff
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// KeyNamingCamelCase names fields without a json name in camelCase, e.g. UserID becomes userId.
+	KeyNamingCamelCase = "camelCase"
+	// KeyNamingSnakeCase names fields without a json name in snake_case, e.g. UserID becomes user_id.
+	KeyNamingSnakeCase = "snake_case"
+	// KeyNamingKebabCase names fields without a json name in kebab-case, e.g. UserID becomes user-id.
+	KeyNamingKebabCase = "kebab-case"
+)
+
+// namingKey identifies a cached converted field name.
+type namingKey struct {
+	strategy string
+	name     string
+}
+
+// namingCache caches the converted field names per strategy, the conversion happens for every marshalled field.
+var namingCache sync.Map // map[namingKey]string
+
+// applyKeyNaming converts the Go field name according to the naming strategy, see the KeyNaming constants.
+// Unknown strategies leave the name unchanged.
+func applyKeyNaming(strategy, name string) string {
+	key := namingKey{strategy: strategy, name: name}
+	if converted, ok := namingCache.Load(key); ok {
+		return converted.(string)
+	}
+
+	words := splitWords(name)
+	var converted string
+	switch strategy {
+	case KeyNamingCamelCase:
+		for i, word := range words {
+			word = strings.ToLower(word)
+			if i > 0 {
+				r, size := utf8.DecodeRuneInString(word)
+				word = string(unicode.ToUpper(r)) + word[size:]
+			}
+			converted += word
+		}
+	case KeyNamingSnakeCase:
+		converted = strings.ToLower(strings.Join(words, "_"))
+	case KeyNamingKebabCase:
+		converted = strings.ToLower(strings.Join(words, "-"))
+	default:
+		converted = name
+	}
+
+	namingCache.Store(key, converted)
+	return converted
+}
+
+// splitWords splits a Go identifier into its words. Acronyms are kept together, e.g. HTTPServer results in
+// HTTP and Server, underscores separate words as well.
+func splitWords(name string) []string {
+	var words []string
+	runes := []rune(name)
+	start := 0
+	for i := 0; i < len(runes); i++ {
+		if runes[i] == '_' {
+			if i > start {
+				words = append(words, string(runes[start:i]))
+			}
+			start = i + 1
+			continue
+		}
+		if i == start || !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		prev := runes[i-1]
+		nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if unicode.IsLower(prev) || unicode.IsDigit(prev) || unicode.IsUpper(prev) && nextLower {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	if start < len(runes) {
+		words = append(words, string(runes[start:]))
+	}
+	return words
+}
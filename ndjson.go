@@ -0,0 +1,96 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// ErrNDJSONRequiresSlice is returned by MarshalNDJSON if the data isn't a slice or an array.
+var ErrNDJSONRequiresSlice = errors.New("sheriff: MarshalNDJSON requires a slice or an array")
+
+// flusher is implemented by writers buffering their output, e.g. *bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// responseFlusher is implemented by writers flushing without reporting an error, e.g. an http.ResponseWriter
+// implementing http.Flusher. It's declared here in order not to depend on net/http.
+type responseFlusher interface {
+	Flush()
+}
+
+// MarshalNDJSON writes the elements of the top-level slice or array data as newline-delimited JSON to w,
+// one marshalled element per line. The elements are filtered the same way as by Marshal.
+//
+// Every line is flushed right away if w is a *bufio.Writer, an http.Flusher or any other writer having a
+// Flush method, which allows streaming exports. Writing stops at the first error.
+func MarshalNDJSON(w io.Writer, options *Options, data interface{}) error {
+	v := reflect.ValueOf(data)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array || isByteSlice(v) {
+		return ErrNDJSONRequiresSlice
+	}
+
+	return eachElement(options.withState(), v, func(d interface{}) error {
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+		return flush(w)
+	})
+}
+
+// flush flushes w if it buffers its output.
+func flush(w io.Writer) error {
+	switch f := w.(type) {
+	case flusher:
+		return f.Flush()
+	case responseFlusher:
+		f.Flush()
+	}
+	return nil
+}
+
+// eachElement marshals the elements of the slice or array v one by one and passes them to f, stopping at the first
+// error. It honours options.ElementFilter, options.DefaultMaxItems, options.Compact and options.ValueRedactors like
+// Marshal does.
+func eachElement(options *Options, v reflect.Value, f func(d interface{}) error) error {
+	// n counts the marshalled elements for DefaultMaxItems, including the ones dropped by Compact
+	n := 0
+	for i := 0; i < v.Len(); i++ {
+		include, err := includeElement(options, i, v.Index(i))
+		if err != nil {
+			return err
+		}
+		if !include {
+			continue
+		}
+		if options.DefaultMaxItems > 0 && n == options.DefaultMaxItems {
+			break
+		}
+
+		d, err := marshalElement(options, v.Index(i))
+		if err != nil {
+			return wrapFieldError(err, "["+strconv.Itoa(i)+"]")
+		}
+		n++
+		if options.Compact {
+			var ok bool
+			if d, ok = compactValue(options, d); !ok {
+				continue
+			}
+		}
+		if err := f(redactTopLevel(options, d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
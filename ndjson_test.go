@@ -0,0 +1,104 @@
+package sheriff
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalNDJSON(t *testing.T) {
+	models := []TestGroupsModel{
+		{DefaultMarshal: "a", OnlyGroupTest: "1"},
+		{DefaultMarshal: "b", OnlyGroupTest: "2"},
+		{DefaultMarshal: "c", OnlyGroupTest: "3"},
+	}
+
+	var buf bytes.Buffer
+	err := MarshalNDJSON(&buf, &Options{Groups: []string{"test"}}, models)
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 3)
+	for i, line := range lines {
+		assert.True(t, json.Valid([]byte(line)), "line %d", i)
+	}
+	assert.Equal(t, `{"group_test_and_other":"","only_group_test":"1"}`, lines[0])
+	assert.Equal(t, `{"group_test_and_other":"","only_group_test":"3"}`, lines[2])
+}
+
+func TestMarshalNDJSON_Array(t *testing.T) {
+	var buf bytes.Buffer
+	err := MarshalNDJSON(&buf, &Options{}, &[2]AModel{{true, true}, {false, false}})
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"something\":true,\"something_else\":true}\n{\"something\":false,\"something_else\":false}\n", buf.String())
+}
+
+// countingFlusher counts the lines written before every flush.
+type countingFlusher struct {
+	bytes.Buffer
+	flushedLines []int
+}
+
+func (f *countingFlusher) Flush() error {
+	f.flushedLines = append(f.flushedLines, strings.Count(f.String(), "\n"))
+	return nil
+}
+
+func TestMarshalNDJSON_FlushesPerElement(t *testing.T) {
+	var w countingFlusher
+	err := MarshalNDJSON(&w, &Options{}, []int{1, 2, 3})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, w.flushedLines)
+
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	err = MarshalNDJSON(bw, &Options{}, []int{1, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n2\n", buf.String())
+}
+
+func TestMarshalNDJSON_StopsOnError(t *testing.T) {
+	models := make([]ParallelFailing, 200)
+	for i := range models {
+		models[i] = ParallelFailing{ID: i}
+	}
+
+	var buf bytes.Buffer
+	err := MarshalNDJSON(&buf, &Options{}, models)
+	assert.EqualError(t, err, "field [99]: element 99 failed")
+	assert.Equal(t, 99, strings.Count(buf.String(), "\n"))
+}
+
+func TestMarshalNDJSON_Filtered(t *testing.T) {
+	o := &Options{
+		DefaultMaxItems: 2,
+		ElementFilter: func(index int, value reflect.Value) (bool, error) {
+			return index != 1, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	err := MarshalNDJSON(&buf, o, []int{1, 2, 3, 4})
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n3\n", buf.String())
+}
+
+func TestMarshalNDJSON_Compact(t *testing.T) {
+	var buf bytes.Buffer
+	err := MarshalNDJSON(&buf, &Options{Compact: true}, []CompactLeaf{{}, {Name: "a"}, {Tags: []string{}}, {Name: "b"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"name\":\"a\"}\n{\"name\":\"b\"}\n", buf.String())
+}
+
+func TestMarshalNDJSON_RequiresSlice(t *testing.T) {
+	var buf bytes.Buffer
+	assert.True(t, errors.Is(MarshalNDJSON(&buf, &Options{}, AModel{}), ErrNDJSONRequiresSlice))
+	assert.True(t, errors.Is(MarshalNDJSON(&buf, &Options{}, []byte("bytes")), ErrNDJSONRequiresSlice))
+	assert.Empty(t, buf.String())
+}
@@ -0,0 +1,58 @@
+package sheriff
+
+import (
+	"reflect"
+	"sync"
+)
+
+// optionalLayout describes the fields of an optional wrapper type, see Options.UnwrapOptionals.
+type optionalLayout struct {
+	// ok is false if the type isn't an optional wrapper
+	ok      bool
+	value   int
+	present int
+}
+
+var optionalLayoutCache sync.Map // map[reflect.Type]optionalLayout
+
+// cachedOptionalLayout returns the optionalLayout of the struct type t.
+//
+// A struct is considered to be an optional wrapper if it has exactly two exported fields: a bool named
+// Present or Valid and the wrapped value. Unexported fields are allowed.
+func cachedOptionalLayout(t reflect.Type) optionalLayout {
+	if l, ok := optionalLayoutCache.Load(t); ok {
+		return l.(optionalLayout)
+	}
+
+	l := optionalLayout{value: -1, present: -1}
+	exported := 0
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		exported++
+		if field.Type.Kind() == reflect.Bool && (field.Name == "Present" || field.Name == "Valid") && l.present == -1 {
+			l.present = i
+		} else {
+			l.value = i
+		}
+	}
+	l.ok = exported == 2 && l.present != -1 && l.value != -1
+
+	optionalLayoutCache.Store(t, l)
+	return l
+}
+
+// unwrapOptional returns the wrapped value of the optional v and whether it's present.
+// The last return value is false if v isn't an optional wrapper.
+func unwrapOptional(v reflect.Value) (reflect.Value, bool, bool) {
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false, false
+	}
+	l := cachedOptionalLayout(v.Type())
+	if !l.ok {
+		return reflect.Value{}, false, false
+	}
+	return v.Field(l.value), v.Field(l.present).Bool(), true
+}
@@ -0,0 +1,43 @@
+package sheriff
+
+import "github.com/hashicorp/go-version"
+
+// An Option configures Options created using NewOptions.
+type Option func(*Options)
+
+// NewOptions creates new Options and applies the passed Option functions in order.
+func NewOptions(opts ...Option) *Options {
+	o := &Options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithGroups adds the passed groups to Options.Groups.
+func WithGroups(groups ...string) Option {
+	return func(o *Options) {
+		o.Groups = append(o.Groups, groups...)
+	}
+}
+
+// WithApiVersion sets Options.ApiVersion.
+func WithApiVersion(v *version.Version) Option {
+	return func(o *Options) {
+		o.ApiVersion = v
+	}
+}
+
+// WithIncludeEmptyTag sets Options.IncludeEmptyTag.
+func WithIncludeEmptyTag() Option {
+	return func(o *Options) {
+		o.IncludeEmptyTag = true
+	}
+}
+
+// WithFieldFilter sets Options.FieldFilter.
+func WithFieldFilter(filter FieldFilter) Option {
+	return func(o *Options) {
+		o.FieldFilter = filter
+	}
+}
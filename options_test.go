@@ -0,0 +1,51 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOptions(t *testing.T) {
+	v2, err := version.NewVersion("2.0.0")
+	assert.NoError(t, err)
+
+	o := NewOptions(
+		WithGroups("test"),
+		WithGroups("test-other"),
+		WithApiVersion(v2),
+		WithIncludeEmptyTag(),
+	)
+	assert.Equal(t, []string{"test", "test-other"}, o.Groups)
+	assert.Equal(t, v2, o.ApiVersion)
+	assert.True(t, o.IncludeEmptyTag)
+	assert.Nil(t, o.FieldFilter)
+
+	assert.Equal(t, &Options{}, NewOptions())
+}
+
+func TestNewOptions_Marshal(t *testing.T) {
+	testModel := &TestGroupsModel{
+		DefaultMarshal:     "DefaultMarshal",
+		OnlyGroupTest:      "OnlyGroupTest",
+		OnlyGroupTestOther: "OnlyGroupTestOther",
+	}
+
+	m, err := Marshal(NewOptions(WithGroups("test"), WithIncludeEmptyTag()), testModel)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"default_marshal":"DefaultMarshal","group_test_and_other":"","include_empty_tag":"","only_group_test":"OnlyGroupTest"}`, string(d))
+
+	o := NewOptions(WithFieldFilter(func(field reflect.StructField) (bool, error) {
+		return field.Name == "OnlyGroupTestOther", nil
+	}))
+	m, err = Marshal(o, testModel)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"only_group_test_other":"OnlyGroupTestOther"}`, string(d))
+}
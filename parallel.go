@@ -0,0 +1,126 @@
+package sheriff
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// parallelThreshold is the minimum length of a top-level slice for it to be marshalled in parallel.
+// Below this length the overhead of spawning goroutines outweighs the gain.
+const parallelThreshold = 128
+
+// canMarshalParallel checks whether v is a top-level slice which should be marshalled in parallel.
+func canMarshalParallel(options *Options, v reflect.Value) bool {
+	if options.Parallelism <= 1 || v.Kind() != reflect.Slice || v.Len() <= parallelThreshold {
+		return false
+	}
+
+	// slices implementing one of the self marshalling interfaces or having a TypeMarshaller are not marshalled
+	// element by element.
+	_, hasTypeMarshaller := typeMarshaller(options, v)
+	return !isSelfMarshalling(v) && !isByteSlice(v) && !hasTypeMarshaller
+}
+
+// marshalParallel marshals the elements of the slice v across options.Parallelism goroutines.
+//
+// The elements passing the options.ElementFilter are determined upfront, up to options.DefaultMaxItems, so only
+// the elements which are part of the output are marshalled, like in the sequential path. They are split into
+// contiguous chunks, each goroutine marshals one chunk using its own copy of the options.
+// The order of the elements is preserved and the error of the lowest failing element is returned. Once an element
+// failed, the workers skip the elements after it, whose output would be discarded anyway.
+func marshalParallel(options *Options, v reflect.Value) (interface{}, error) {
+	l := v.Len()
+	filterOptions := options.withState()
+	indices := make([]int, 0, l)
+	for i := 0; i < l; i++ {
+		include, err := includeElement(filterOptions, i, v.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		if !include {
+			continue
+		}
+		if options.DefaultMaxItems > 0 && len(indices) == options.DefaultMaxItems {
+			break
+		}
+		indices = append(indices, i)
+	}
+
+	dest := make([]interface{}, l)
+	included := make([]bool, l)
+	if len(indices) == 0 {
+		d, _ := assembleSlice(filterOptions, dest, included, 0)
+		return d, nil
+	}
+
+	workers := options.Parallelism
+	if workers > len(indices) {
+		workers = len(indices)
+	}
+	chunkSize := (len(indices) + workers - 1) / workers
+	errs := make([]error, workers)
+
+	// the workers share the types reported to OnType, in order to report every type once per call
+	var seenTypes *typeSet
+	if options.OnType != nil {
+		seenTypes = newTypeSet()
+	}
+	// as well as the number of emitted elements
+	elements := new(int64)
+	// and the index of the lowest failing element
+	failed := new(int64)
+	*failed = math.MaxInt64
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		start := w * chunkSize
+		end := start + chunkSize
+		if end > len(indices) {
+			end = len(indices)
+		}
+
+		wg.Add(1)
+		go func(w int, chunk []int) {
+			defer wg.Done()
+
+			workerOptions := options.withState()
+			workerOptions.state.seenTypes = seenTypes
+			workerOptions.state.elements = elements
+			for _, i := range chunk {
+				if int64(i) > atomic.LoadInt64(failed) {
+					return
+				}
+				d, err := marshalElement(workerOptions, v.Index(i))
+				if err != nil {
+					errs[w] = wrapFieldError(err, "["+strconv.Itoa(i)+"]")
+					markFailed(failed, int64(i))
+					return
+				}
+				dest[i] = d
+				included[i] = true
+			}
+		}(w, indices[start:end])
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	d, _ := assembleSlice(filterOptions, dest, included, 0)
+	return d, nil
+}
+
+// markFailed lowers the index of the lowest failing element to i.
+func markFailed(failed *int64, i int64) {
+	for {
+		current := atomic.LoadInt64(failed)
+		if i >= current || atomic.CompareAndSwapInt64(failed, current, i) {
+			return
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ParallelModel struct {
+	ID     int    `json:"id" groups:"api"`
+	Secret string `json:"secret" groups:"internal"`
+	ParallelEmbedded
+}
+
+type ParallelEmbedded struct {
+	Name string `json:"name" groups:"api"`
+}
+
+type ParallelFailing struct {
+	ID int `json:"id"`
+}
+
+func (p ParallelFailing) Marshal(options *Options) (interface{}, error) {
+	if p.ID%100 == 99 {
+		return nil, fmt.Errorf("element %d failed", p.ID)
+	}
+	return Marshal(options, struct {
+		ID int `json:"id"`
+	}{p.ID})
+}
+
+func TestMarshal_Parallel(t *testing.T) {
+	models := make([]ParallelModel, 1000)
+	for i := range models {
+		models[i] = ParallelModel{ID: i, Secret: "secret", ParallelEmbedded: ParallelEmbedded{Name: fmt.Sprintf("name-%d", i)}}
+	}
+
+	sequential, err := Marshal(&Options{Groups: []string{"api"}}, models)
+	assert.NoError(t, err)
+
+	o := &Options{Groups: []string{"api"}, Parallelism: 8}
+	parallel, err := Marshal(o, models)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(sequential)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(parallel)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+
+	result := parallel.([]interface{})
+	assert.Len(t, result, 1000)
+	for i, r := range result {
+		assert.Equal(t, i, r.(KVStore).(kvStore)["id"])
+	}
+}
+
+func TestMarshal_ParallelError(t *testing.T) {
+	models := make([]ParallelFailing, 1000)
+	for i := range models {
+		models[i] = ParallelFailing{ID: i}
+	}
+
+	_, err := Marshal(&Options{Parallelism: 4}, models)
+	assert.EqualError(t, err, "field [99]: element 99 failed")
+}
+
+type ParallelSlow struct {
+	ID      int
+	counter *int64
+}
+
+func (p ParallelSlow) Marshal(options *Options) (interface{}, error) {
+	atomic.AddInt64(p.counter, 1)
+	if p.ID == 0 {
+		return nil, errors.New("element 0 failed")
+	}
+	time.Sleep(time.Millisecond)
+	return p.ID, nil
+}
+
+func TestMarshal_ParallelErrorStopsWorkers(t *testing.T) {
+	counter := new(int64)
+	models := make([]ParallelSlow, 1000)
+	for i := range models {
+		models[i] = ParallelSlow{ID: i, counter: counter}
+	}
+
+	_, err := Marshal(&Options{Parallelism: 4}, models)
+	assert.EqualError(t, err, "field [0]: element 0 failed")
+	// the other workers stop after the element they're marshalling when the first one fails
+	assert.Less(t, atomic.LoadInt64(counter), int64(100))
+}
+
+func TestMarshal_ParallelDefaultMaxItems(t *testing.T) {
+	models := make([]ParallelFailing, 1000)
+	for i := range models {
+		models[i] = ParallelFailing{ID: i}
+	}
+
+	// like the sequential path, the elements beyond the cap are never marshalled
+	for _, parallelism := range []int{0, 4} {
+		actual, err := Marshal(&Options{DefaultMaxItems: 10, Parallelism: parallelism}, models)
+		assert.NoError(t, err, "parallelism %d", parallelism)
+		assert.Len(t, actual, 10, "parallelism %d", parallelism)
+	}
+
+	// the cap applies to the elements passing the filter
+	o := &Options{
+		DefaultMaxItems: 10,
+		Parallelism:     4,
+		ElementFilter: func(index int, value reflect.Value) (bool, error) {
+			return index%2 == 1, nil
+		},
+	}
+	actual, err := Marshal(o, models)
+	assert.NoError(t, err)
+	d, err := json.Marshal(actual)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"id":1},{"id":3},{"id":5},{"id":7},{"id":9},{"id":11},{"id":13},{"id":15},{"id":17},{"id":19}]`, string(d))
+}
+
+func TestMarshal_ParallelElementFilter(t *testing.T) {
+	models := make([]int, 1000)
+	for i := range models {
+		models[i] = i
+	}
+
+	o := &Options{
+		Parallelism: 3,
+		ElementFilter: func(index int, value reflect.Value) (bool, error) {
+			return index%2 == 0, nil
+		},
+	}
+	m, err := Marshal(o, models)
+	assert.NoError(t, err)
+
+	result := m.([]interface{})
+	assert.Len(t, result, 500)
+	for i, r := range result {
+		assert.Equal(t, i*2, r)
+	}
+}
+
+func TestMarshal_ParallelOnType(t *testing.T) {
+	models := make([]ParallelModel, 1000)
+
+	var mu sync.Mutex
+	seen := map[reflect.Type]int{}
+	o := &Options{
+		Parallelism: 8,
+		OnType: func(t reflect.Type) {
+			mu.Lock()
+			defer mu.Unlock()
+			seen[t]++
+		},
+	}
+
+	_, err := Marshal(o, models)
+	assert.NoError(t, err)
+	assert.Equal(t, map[reflect.Type]int{
+		reflect.TypeOf(ParallelModel{}):    1,
+		reflect.TypeOf(ParallelEmbedded{}): 1,
+	}, seen)
+}
+
+func TestMarshal_ParallelTypeMarshaller(t *testing.T) {
+	models := make([]ParallelModel, 1000)
+	o := &Options{
+		Parallelism: 4,
+		TypeMarshallers: map[reflect.Type]func(value interface{}) (interface{}, error){
+			reflect.TypeOf(models): func(value interface{}) (interface{}, error) {
+				return len(value.([]ParallelModel)), nil
+			},
+		},
+	}
+
+	for _, data := range []interface{}{models, &models} {
+		m, err := Marshal(o, data)
+		assert.NoError(t, err)
+		assert.Equal(t, 1000, m)
+	}
+}
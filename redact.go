@@ -0,0 +1,90 @@
+package sheriff
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+)
+
+// redactTopLevel applies options.ValueRedactors to every string of the marshalled top-level data.
+// It runs on the finished output, which covers the values of Marshallers, TypeMarshallers, via methods,
+// `default_groups` literals and `rawjson` fields as well.
+func redactTopLevel(options *Options, d interface{}) interface{} {
+	if len(options.ValueRedactors) == 0 {
+		return d
+	}
+	return redactTree(options, d)
+}
+
+// redactTree returns a copy of the marshalled value d whose strings have been redacted.
+// Objects and slices are copied, as e.g. a Marshaller may return a map it shares with other values.
+func redactTree(options *Options, d interface{}) interface{} {
+	switch d := d.(type) {
+	case nil, json.Number:
+		return d
+	case string:
+		return redactValue(options, d)
+	case json.RawMessage:
+		return redactRawJSON(options, d)
+	case KVStore:
+		dest := options.KVStoreFactory()
+		d.Each(func(k string, v interface{}) {
+			dest.Set(k, redactTree(options, v))
+		})
+		return dest
+	case map[string]interface{}:
+		dest := make(map[string]interface{}, len(d))
+		for k, v := range d {
+			dest[k] = redactTree(options, v)
+		}
+		return dest
+	case []interface{}:
+		dest := make([]interface{}, len(d))
+		for i, v := range d {
+			dest[i] = redactTree(options, v)
+		}
+		return dest
+	}
+
+	// named string types, e.g. passed through because they implement fmt.Stringer
+	if s, ok := redactableString(reflect.ValueOf(d)); ok {
+		return redactValue(options, s)
+	}
+	return d
+}
+
+// redactRawJSON redacts the strings of the raw JSON, which is decoded and encoded again for that.
+// Invalid JSON is returned unchanged.
+func redactRawJSON(options *Options, raw json.RawMessage) interface{} {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		return raw
+	}
+	b, err := json.Marshal(redactTree(options, decoded))
+	if err != nil {
+		return raw
+	}
+	return json.RawMessage(b)
+}
+
+// redactableString returns the string v holds or points to, unless it's encoded by its own MarshalJSON or
+// MarshalText method or is a json.Number.
+func redactableString(v reflect.Value) (string, bool) {
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.String || v.Type() == jsonNumberType || implementsMarshaler(v.Type()) {
+		return "", false
+	}
+	return v.String(), true
+}
+
+// redactValue applies all options.ValueRedactors to the passed string.
+func redactValue(options *Options, s string) string {
+	for _, redactor := range options.ValueRedactors {
+		s = redactor.Pattern.ReplaceAllString(s, redactor.Replacement)
+	}
+	return s
+}
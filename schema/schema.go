@@ -0,0 +1,84 @@
+// Package schema validates the output of sheriff against a JSON Schema.
+//
+// It's a separate package in order to keep the JSON Schema engine out of the dependencies of sheriff itself.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/liip/sheriff/v2"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ErrSchemaViolation is returned by MarshalValidated if the output doesn't conform to the schema.
+var ErrSchemaViolation = errors.New("sheriff: output does not conform to the schema")
+
+// schemaURL is the URL the schema passed to MarshalValidated is registered with.
+const schemaURL = "sheriff://schema.json"
+
+// MarshalValidated marshals the passed data using sheriff.Marshal and validates the JSON encoding of the result against
+// the passed JSON Schema. This catches drift between the models and the documented contract at runtime.
+//
+// A violation results in an error wrapping ErrSchemaViolation, its message lists the paths of the invalid values.
+// The schema is compiled on every call, callers validating many values should cache the result instead.
+func MarshalValidated(options *sheriff.Options, data interface{}, schema []byte) (interface{}, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(schemaURL, bytes.NewReader(schema)); err != nil {
+		return nil, fmt.Errorf("sheriff: invalid schema: %w", err)
+	}
+	compiled, err := compiler.Compile(schemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("sheriff: invalid schema: %w", err)
+	}
+
+	v, err := sheriff.Marshal(options, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// validate the JSON as clients see it, e.g. with time.Time encoded as a string
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	if err := compiled.Validate(doc); err != nil {
+		var validationErr *jsonschema.ValidationError
+		if errors.As(err, &validationErr) {
+			return nil, fmt.Errorf("%w: %s", ErrSchemaViolation, validationErrorDetails(validationErr))
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// validationErrorDetails lists the leaf errors of a ValidationError with the paths of the invalid values.
+func validationErrorDetails(err *jsonschema.ValidationError) string {
+	var details []string
+	var collect func(e *jsonschema.ValidationError)
+	collect = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			location := e.InstanceLocation
+			if location == "" {
+				location = "/"
+			}
+			details = append(details, fmt.Sprintf("%s: %s", location, e.Message))
+			return
+		}
+		for _, cause := range e.Causes {
+			collect(cause)
+		}
+	}
+	collect(err)
+	return strings.Join(details, "; ")
+}
@@ -0,0 +1,56 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/liip/sheriff/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+var userSchema = []byte(`{
+	"type": "object",
+	"required": ["username", "email"],
+	"properties": {
+		"username": {"type": "string"},
+		"email": {"type": "string"},
+		"age": {"type": "integer", "minimum": 0}
+	}
+}`)
+
+type SchemaUser struct {
+	Username string `json:"username" groups:"api,public"`
+	Email    string `json:"email" groups:"api"`
+	Age      int    `json:"age" groups:"api,public"`
+}
+
+func TestMarshalValidated(t *testing.T) {
+	v := SchemaUser{Username: "alice", Email: "alice@example.com", Age: 30}
+
+	actualMap, err := MarshalValidated(&sheriff.Options{Groups: []string{"api"}}, v, userSchema)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"age":30,"email":"alice@example.com","username":"alice"}`, string(actual))
+}
+
+func TestMarshalValidated_MissingRequiredField(t *testing.T) {
+	v := SchemaUser{Username: "alice", Email: "alice@example.com", Age: 30}
+
+	_, err := MarshalValidated(&sheriff.Options{Groups: []string{"public"}}, v, userSchema)
+	assert.True(t, errors.Is(err, ErrSchemaViolation))
+	assert.EqualError(t, err, "sheriff: output does not conform to the schema: /: missing properties: 'email'")
+}
+
+func TestMarshalValidated_InvalidValue(t *testing.T) {
+	v := SchemaUser{Username: "alice", Email: "alice@example.com", Age: -1}
+
+	_, err := MarshalValidated(&sheriff.Options{Groups: []string{"api"}}, v, userSchema)
+	assert.EqualError(t, err, "sheriff: output does not conform to the schema: /age: must be >= 0 but found -1")
+}
+
+func TestMarshalValidated_InvalidSchema(t *testing.T) {
+	_, err := MarshalValidated(&sheriff.Options{}, SchemaUser{}, []byte(`{"type": 1`))
+	assert.ErrorContains(t, err, "sheriff: invalid schema")
+}
@@ -1,11 +1,20 @@
 package sheriff
 
 import (
+	"context"
 	"encoding"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"path"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-version"
 )
@@ -23,7 +32,30 @@ type KVStore interface {
 // If it returns true, the field will be marshalled, otherwise it will be skipped.
 type FieldFilter func(field reflect.StructField) (bool, error)
 
+// An ElementFilter is a function that decides whether an element of a slice should be marshalled or not.
+// It receives the index and the value of the element, if it returns true the element will be marshalled,
+// otherwise it will be skipped.
+type ElementFilter func(index int, value reflect.Value) (bool, error)
+
+// A ValueRedactor masks parts of string values matching the Pattern.
+// The Replacement supports the same syntax as regexp.Regexp.ReplaceAllString, e.g. `$1` for
+// keeping a submatch in order to mask values partially.
+type ValueRedactor struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// TimeObjectKeys are the keys of the representations of a time marshalled using Options.TimeAsObject.
+// Empty keys default to "iso" and "unix".
+type TimeObjectKeys struct {
+	ISO  string
+	Unix string
+}
+
 // Options determine which struct fields are being added to the output map.
+//
+// Independent of the options, the `,string` json option on a field whose type implements json.Marshaler or
+// encoding.TextMarshaler, e.g. time.Time, results in an error instead of being ignored like in encoding/json.
 type Options struct {
 	// The FieldFilter makes the decision whether a field should be marshalled or not.
 	// It receives the reflect.StructField of the field and should return true if the field should be included.
@@ -34,7 +66,65 @@ type Options struct {
 	// Groups determine which fields are getting marshalled based on the groups tag.
 	// A field with multiple groups (comma-separated) will result in marshalling of that
 	// field if one of their groups is specified.
+	// The wildcard group "*" matches every field having at least one group.
 	Groups []string
+	// DefaultGroups are used instead of Groups if no Groups are set, e.g. in order to default to a safe public view
+	// instead of marshalling all fields. Marshallers receive them as the Groups of the options.
+	// If both are empty, the group tags are ignored.
+	DefaultGroups []string
+
+	// GroupAliases maps a group to the groups it stands for, e.g. "mobile" to "core", "list" and "thumbnail".
+	// Requesting an alias requests its groups as well, aliases can refer to other aliases.
+	// The requested groups are expanded before any other group option is applied.
+	GroupAliases map[string][]string
+
+	// FallbackGroups are used instead of Groups if marshalling a struct with the requested Groups results in an
+	// empty object. This guarantees a minimal response. It only applies to the top-level object.
+	// The fallback marshals the struct a second time, so OnType, ValidateBeforeMarshal, Marshaller and via methods
+	// and computed fields are invoked again for it.
+	FallbackGroups []string
+	// GroupKeyDeny maps a group to key patterns which are stripped from every object whenever that group is requested,
+	// independent of the groups tags of the fields. This covers the keys of structs, maps, KVStore values and the
+	// objects returned by embedded Marshallers. The patterns use the syntax of path.Match, e.g. "*_internal".
+	GroupKeyDeny map[string][]string
+	// CaseInsensitiveGroups compares the requested groups with the groups of the tags ignoring the case,
+	// e.g. requesting "API" matches `groups:"api"`.
+	// The groups of GroupAliases and GroupKeyDeny are looked up ignoring the case as well.
+	// This option is false by default.
+	CaseInsensitiveGroups bool
+	// MatchAllGroups changes the matching of Groups to require every requested group to be present in the
+	// groups tag of a field, instead of at least one of them.
+	// Fields without groups are still marshalled if IncludeEmptyTag is set.
+	// This option is false by default.
+	MatchAllGroups bool
+	// DeepMergeFlattenedMaps merges objects whose keys collide because of a flattened embedded struct, e.g. a map
+	// field of the embedded struct and a map field of the same name of the embedding struct, recursively.
+	// Conflicting values which aren't both objects are overwritten by the field declared last, like without this
+	// option. This option is false by default.
+	DeepMergeFlattenedMaps bool
+	// DisableEmbeddedGroupInheritance stops the fields of anonymous structs from inheriting the groups tag of the
+	// anonymous field, the groups tags of the fields themselves are authoritative then.
+	// This option is false by default.
+	DisableEmbeddedGroupInheritance bool
+	// InheritFieldGroups makes the untagged fields of nested structs inherit the groups of the named field holding
+	// the struct, like the fields of anonymous structs do. This also applies to structs in slices and maps.
+	// Single fields can opt in using the inherit option of the groups tag, e.g. `groups:"api,inherit"`.
+	// This option is false by default.
+	InheritFieldGroups bool
+	// DenyGroups determine which fields are never getting marshalled based on the groups tag.
+	// A field having one of these groups is skipped, even if it also has one of the requested Groups.
+	// This also works without specifying Groups, in order to strip some fields from an otherwise full output.
+	DenyGroups []string
+	// TagName is the name of the tag holding the output key and its options like omitempty, e.g. "yaml".
+	// If this is not set, "json" is used. Fields without the tag use the field name as the key.
+	TagName string
+	// GroupName is the name of the tag listing the groups of a field. If this is not set, "groups" is used.
+	GroupName string
+	// SinceName is the name of the tag holding the version a field has been added. If this is not set, "since" is used.
+	SinceName string
+	// UntilName is the name of the tag holding the last version of a field. If this is not set, "until" is used.
+	UntilName string
+
 	// ApiVersion sets the API version to use when marshalling.
 	// The tags `since` and `until` use the API version setting.
 	// Specifying the API version as "1.0.0" and having an until setting of "2"
@@ -42,21 +132,376 @@ type Options struct {
 	// Specifying a since setting of "2" with the same API version specified,
 	// will not marshal the field.
 	ApiVersion *version.Version
+	// IgnorePrerelease strips the prerelease identifiers of the ApiVersion before comparing it against the since, until
+	// and version tags, e.g. 2.1.0-beta.1 is compared as 2.1.0. By default a prerelease is lower than its release
+	// like in SemVer, so a field tagged with since:"2.1" isn't marshalled for 2.1.0-beta.1. The constraints of the
+	// version tag don't match any prerelease at all, e.g. 2.1.1-rc.1 fails version:">= 2.1".
+	IgnorePrerelease bool
+	// ExclusiveUntil makes the `until` tag exclusive: a field tagged with until:"2" is marshalled for API versions
+	// below 2.0.0 only. By default the tag is inclusive and the field is marshalled for 2.0.0 as well.
+	ExclusiveUntil bool
+	// EmitVersionField adds the ApiVersion under this key to the output of a top-level struct, which allows clients to
+	// check which version shaped the response. It has no effect if ApiVersion is not set or the data isn't a struct.
+	EmitVersionField string
 	// IncludeEmptyTag determines whether a field without the
 	// `groups` tag should be marshalled ot not.
 	// This option is false by default.
 	IncludeEmptyTag bool
+	// EmptyDefinitions overrides the definition of empty values per kind, which is used by the `omitempty` json option
+	// and the `omitempty_groups` tag, e.g. in order to treat -1 as an empty int.
+	// Kinds which aren't part of the map use the definition of encoding/json.
+	EmptyDefinitions map[reflect.Kind]func(reflect.Value) bool
+
+	// OmitDefaults drops every field which is equal to its zero value, regardless of the `omitempty` json option.
+	// Nested structs which are empty after marshalling are dropped as well.
+	// This option is false by default.
+	OmitDefaults bool
+
+	// OmitEmptyStructs extends the `omitempty` json option to structs and pointers to structs which result in an
+	// empty object, e.g. because all of their fields are filtered by the groups or empty and tagged with omitempty.
+	// encoding/json never omits structs. This option is false by default.
+	OmitEmptyStructs bool
+
+	// OmitEmptyNested drops nested structs which result in an empty object because their fields are excluded by the
+	// groups, versions or field filters. Structs which are empty for other reasons, e.g. because they have no fields,
+	// are kept. This option is false by default.
+	OmitEmptyNested bool
 
 	// The KVStoreFactory is a function that returns a new KVStore.
 	// The default implementation uses a map[string]interface{}, which is fast but does not maintain the order of the
 	// keys.
-	// A custom implementation can be used to maintain the order of the keys, i.e. using github.com/wk8/go-ordered-map
+	// NewOrderedKVStore can be used to keep the keys in struct declaration order, a custom implementation
+	// can be used as well, i.e. using github.com/wk8/go-ordered-map
 	KVStoreFactory func() KVStore
 
-	// This is used internally so that we can propagate anonymous fields groups tag to all child field.
+	// NumberFormatter is consulted for every numeric value and may return a replacement, e.g. a formatted string.
+	// It receives the reflect.Kind of the number as well as the number itself.
+	// If this is not set, numbers are marshalled unchanged.
+	NumberFormatter func(kind reflect.Kind, value interface{}) (interface{}, error)
+
+	// MapKeySort sets the order in which the keys of maps are marshalled, see the MapKeySort constants.
+	// The order is only visible in the output if the KVStoreFactory preserves it, e.g. NewOrderedKVStore,
+	// or with MapsAsEntries. Maps implementing Keys() []string keep using their own order.
+	// If this is not set, the keys are sorted lexically like encoding/json does.
+	MapKeySort string
+
+	// KeyNamingStrategy converts the Go names of fields without a json name, see the KeyNaming constants.
+	// Fields with an explicit json name are left alone.
+	// If this is not set, the Go names are used verbatim like encoding/json does.
+	KeyNamingStrategy string
+
+	// MapKeyTransformer is applied to the keys of maps, e.g. in order to normalize the names of headers.
+	// Keys which are transformed to the same key result in ErrDuplicateMapKey.
+	// If this is not set, the keys are marshalled unchanged.
+	MapKeyTransformer func(key string) string
+
+	// NameResolution decides which key of the `rename` tag is used if several of its groups are requested,
+	// see the NameResolution constants.
+	// If this is not set, the rule of the group listed first in Groups wins.
+	NameResolution string
+
+	// UintFormat sets the representation of unsigned integers (uint, uint8, ..., uint64), see the UintFormat constants.
+	// It does not affect signed integers and byte slices, and takes precedence over the NumberFormatter.
+	// If this is not set, unsigned integers are marshalled as decimal numbers.
+	UintFormat string
+
+	// Parallelism sets the number of goroutines used for marshalling the elements of a top-level slice.
+	// It only has an effect on slices longer than an internal threshold, the order of the elements is preserved.
+	// A value of 0 or 1 disables parallel marshalling.
+	Parallelism int
+
+	// The ElementFilter makes the decision whether an element of a slice should be marshalled or not.
+	// If this is not set, all elements are marshalled.
+	ElementFilter ElementFilter
+	// SlicesAsIndexedObjects marshals slices as objects keyed by the index of their elements, e.g. {"0": ..., "2": ...}.
+	// Elements skipped by the ElementFilter leave a gap in the index keys.
+	SlicesAsIndexedObjects bool
+
+	// DefaultMaxItems limits the number of marshalled elements of every slice, filtered out elements don't count.
+	// The `maxitems` tag overrides this for a single field. A value of 0 means unlimited.
+	DefaultMaxItems int
+	// MarkTruncated adds a sibling key `<field>_truncated` set to true for every field whose slice has been
+	// truncated because of the `maxitems` tag or DefaultMaxItems.
+	MarkTruncated bool
+
+	// ValueRedactors are applied to every string value in the output, replacing all matches of their pattern.
+	// They run on the finished output, which includes the output of Marshallers, TypeMarshallers and via methods,
+	// `default_groups` literals, `rawjson` fields and named string types implementing fmt.Stringer.
+	// Types encoding themselves using json.Marshaler or encoding.TextMarshaler are not redacted, neither are keys.
+	ValueRedactors []ValueRedactor
+
+	// Redact masks the values of fields tagged with `redact:"true"` instead of marshalling them, the key is kept.
+	// This shows that a field exists without revealing its value, e.g. in audit logs.
+	// This option is false by default.
+	Redact bool
+	// RedactWith returns the value replacing a redacted field. If this is not set, "[REDACTED]" is used.
+	RedactWith func(field reflect.StructField) interface{}
+
+	// ReservedKeys are keys reserved by the consumer of the output, e.g. "id" or "_id" in a document store.
+	// Struct fields resolving to one of them are emitted with the ReservedPrefix prepended, e.g. "_id" instead of "id".
+	ReservedKeys []string
+	// ReservedPrefix is prepended to reserved keys. If this is not set, "_" is used.
+	ReservedPrefix string
+
+	// AssertOnlyKeys verifies after marshalling that the top-level object contains no other keys than the listed
+	// ones. If an unexpected key is found, an error wrapping ErrUnexpectedKeys listing the offending keys is returned.
+	// This is a defense-in-depth measure against tagging mistakes exposing sensitive fields.
+	AssertOnlyKeys []string
+
+	// NilInterfaceAsEmptyObject marshals nil fields of an interface type as an empty object instead of null.
+	// This option is false by default.
+	NilInterfaceAsEmptyObject bool
+
+	// NilBoolInMapAs replaces nil *bool values of maps and slices, e.g. of a map[string]*bool, for clients which
+	// can't handle null booleans. It's usually set to false. Struct fields and values of interface maps like
+	// map[string]interface{} are not affected. If this is not set, nil values are marshalled as null.
+	NilBoolInMapAs interface{}
+
+	// MaxFieldsPerObject limits the number of keys of every marshalled object.
+	// Exceeding it results in an error wrapping ErrTooManyFields, as a guardrail against accidentally
+	// exposing very wide structs. A value of 0 means unlimited.
+	MaxFieldsPerObject int
+
+	// ValidateBeforeMarshal calls the Validate() error method of every marshalled struct implementing it, either
+	// on its value or on its pointer, before its fields are marshalled. An error aborts the marshalling and is
+	// returned with the path of the struct, which keeps invalid data from reaching clients.
+	ValidateBeforeMarshal bool
+
+	// MaxTotalElements limits the number of values emitted by a single call, counting every field, slice element
+	// and map value across the whole output. Exceeding it results in an error wrapping ErrTooManyElements, which
+	// protects against nested structures fanning out into millions of values. A value of 0 means unlimited.
+	MaxTotalElements int
+
+	// RelativeTime marshals time.Time values as a humanized string relative to now, e.g. "3 hours ago" or
+	// "in 2 days". Zero times are marshalled as null.
+	// The same can be achieved for single fields using the `timeformat:"relative"` tag.
+	RelativeTime bool
+	// Now returns the current time used by RelativeTime. If this is not set, time.Now is used.
+	Now func() time.Time
+	// TimeAsObject marshals time.Time values as an object containing multiple representations,
+	// e.g. {"iso": "2017-01-20T18:11:00Z", "unix": 1484935860}. Zero times are marshalled as null.
+	// It takes precedence over RelativeTime, while the `timeformat` tag of a field takes precedence over both.
+	TimeAsObject bool
+	// TimeObjectKeys configures the keys of the object created by TimeAsObject.
+	TimeObjectKeys TimeObjectKeys
+	// TimeLayout formats time.Time values using the layout, e.g. time.RFC1123, instead of RFC 3339.
+	// TimeLayoutUnix marshals them as unix timestamps in seconds. Zero times are formatted like any other time,
+	// like with encoding/json they are not considered to be empty by omitempty.
+	// TimeAsObject, RelativeTime and the `timeformat` tag of a field take precedence over it.
+	TimeLayout string
+
+	// MapsAsEntries marshals maps as a slice of entries, e.g. [{"key": 1, "value": "one"}], instead of an object.
+	// The keys are marshalled like any other value, which preserves e.g. integer keys for typed clients.
+	// The entries are in the same order as the keys of the object would be.
+	MapsAsEntries bool
+
+	// Compact recursively drops every empty object, empty array, null and empty string from the output after
+	// filtering. Note that this is aggressive: it also drops values which are empty on purpose, e.g. an empty
+	// string which clients need to distinguish from a missing key. This option is false by default.
+	Compact bool
+
+	// OnType is called the first time each distinct struct type is entered during a single Marshal call,
+	// e.g. in order to collect the types for schema generation. It doesn't change the output.
+	// With Parallelism it may be called concurrently.
+	OnType func(t reflect.Type)
+
+	// ContextFieldFilter is like FieldFilter but also receives the context passed to MarshalWithContext, e.g. in
+	// order to decide the visibility based on the permissions of the authenticated user.
+	// It takes precedence over FieldFilter and the default filter. Marshal passes context.Background().
+	ContextFieldFilter func(ctx context.Context, field reflect.StructField) (bool, error)
+
+	// ValueTransformer is called with the marshalled value of each included leaf field, i.e. each field not resulting
+	// in a nested object or slice, just before it's added to the output. The returned value replaces the marshalled
+	// one, returning an error aborts the marshalling. It runs before the `,string` json option is applied.
+	ValueTransformer func(field reflect.StructField, value interface{}) (interface{}, error)
+
+	// TypeMarshallers marshal the values of the given types, e.g. a Money type which should always be rendered as a
+	// formatted string. A struct field is matched by its declared type, so e.g. a nil *Money field is passed to the
+	// function registered for *Money, and a field declared as an interface is matched by the interface type.
+	// Other values, like elements of slices or values of interface fields, are matched by their concrete type.
+	// A matching function takes precedence over the Marshaller, json.Marshaler and the other supported interfaces.
+	TypeMarshallers map[reflect.Type]func(value interface{}) (interface{}, error)
+
+	// ComputedFields adds keys which aren't backed by struct fields to the output of the given struct types.
+	// They are added after the fields of the struct, see ComputedField.
+	ComputedFields map[reflect.Type][]ComputedField
+
+	// ComputedOverride makes computed fields replace marshalled fields with the same key.
+	// By default the marshalled field wins and the computed field is skipped.
+	ComputedOverride bool
+
+	// UnwrapOptionals marshals optional wrapper structs as their wrapped value, e.g. `Optional[T]` types like
+	// struct { Value T; Present bool }. A struct is recognised as optional if it has exactly two exported fields,
+	// a bool named Present or Valid and the wrapped value. Absent optionals are marshalled as null and are
+	// considered to be empty by omitempty. Types implementing json.Marshaler or one of the other supported
+	// interfaces keep using their own implementation.
+	UnwrapOptionals bool
+
+	// ValueFieldFilter is like FieldFilter but also receives the value of the field, e.g. in order to hide a field
+	// only when it's zero. It takes precedence over FieldFilter and the default filter, but not over ContextFieldFilter.
+	ValueFieldFilter func(field reflect.StructField, value reflect.Value) (bool, error)
+
+	// ctx is the context of the current call, see MarshalWithContext.
+	ctx context.Context
+	// omitted collects the omitted fields of the current call, see MarshalDebug.
+	omitted map[string]string
+	// fieldGroups override the groups tags of the current call, see MarshalWithFieldGroups.
+	fieldGroups map[string]map[string][]string
+
+	// This is used internally to hold the state of a single Marshal call.
+	state *marshalState
+}
+
+// marshalState holds the state of a single Marshal call.
+// It is never shared between calls, which makes it safe to use the same Options concurrently.
+type marshalState struct {
+	// nestedGroupsMap is used so that we can propagate anonymous fields groups tag to all child field.
 	nestedGroupsMap map[string][]string
+	// deniedKeys are the key patterns of Options.GroupKeyDeny for the requested groups.
+	deniedKeys []string
+	// seenTypes are the struct types already reported to Options.OnType, it's only set if OnType is.
+	seenTypes *typeSet
+	// inheritedGroups are the groups of the named field currently being marshalled, see Options.InheritFieldGroups.
+	inheritedGroups []string
+	// tagNames are the tag names resolved from the options.
+	tagNames tagNames
+	// visitStack and visiting hold the structs, maps and slices currently being marshalled in order to detect cycles.
+	// The first visitStackSize values are kept in visitStack, deeper ones in visiting.
+	visitStack [visitStackSize]visitKey
+	visiting   map[visitKey]bool
+	// depth is the number of values currently being marshalled.
+	depth int
+	// fieldGroupTypes caches the typeInfo of types whose groups are overridden, see MarshalWithFieldGroups.
+	fieldGroupTypes map[reflect.Type]*typeInfo
+	// apiVersion is the Options.ApiVersion the since, until and version tags are compared against.
+	apiVersion *version.Version
+	// debug tracks the omitted fields, it's only set by MarshalDebug.
+	debug *debugInfo
+	// filtered counts the fields excluded by the filter, see Options.OmitEmptyNested.
+	filtered int
+	// elements counts the emitted values for Options.MaxTotalElements, it's only set if there is a limit.
+	elements *int64
+}
+
+// typeSet is a set of types which is safe for concurrent use.
+type typeSet struct {
+	mu    sync.Mutex
+	types map[reflect.Type]bool
 }
 
+// newTypeSet returns an empty typeSet.
+func newTypeSet() *typeSet {
+	return &typeSet{types: make(map[reflect.Type]bool)}
+}
+
+// add adds the type to the set and reports whether it hasn't been part of it before.
+func (s *typeSet) add(t reflect.Type) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.types[t] {
+		return false
+	}
+	s.types[t] = true
+	return true
+}
+
+// call holds the options and the state of a single Marshal call, which allocates both at once.
+type call struct {
+	options Options
+	state   marshalState
+}
+
+// withState returns a copy of the options with the defaults applied and a fresh state attached.
+func (o *Options) withState() *Options {
+	cl := &call{options: *o}
+	c := &cl.options
+	c.state = &cl.state
+	c.state.tagNames = o.tagNames()
+	if c.OnType != nil {
+		c.state.seenTypes = newTypeSet()
+	}
+	if c.MaxTotalElements > 0 {
+		c.state.elements = new(int64)
+	}
+	if c.omitted != nil {
+		c.state.debug = &debugInfo{omitted: c.omitted}
+	}
+	c.state.apiVersion = c.ApiVersion
+	if c.ApiVersion != nil && c.IgnorePrerelease {
+		c.state.apiVersion = c.ApiVersion.Core()
+	}
+	if len(c.Groups) == 0 {
+		c.Groups = c.DefaultGroups
+	}
+	c.Groups = expandGroupAliases(c.Groups, c.GroupAliases, c.CaseInsensitiveGroups)
+	for _, group := range c.Groups {
+		c.state.deniedKeys = append(c.state.deniedKeys, groupEntries(c.GroupKeyDeny, group, c.CaseInsensitiveGroups)...)
+	}
+
+	if c.KVStoreFactory == nil {
+		c.KVStoreFactory = func() KVStore {
+			return kvStore{}
+		}
+	}
+
+	return c
+}
+
+const (
+	// UintFormatDec marshals unsigned integers as decimal numbers, which is the default.
+	UintFormatDec = "dec"
+	// UintFormatHex marshals unsigned integers as lowercase hex strings, e.g. "ff".
+	UintFormatHex = "hex"
+	// UintFormatHexPrefixed marshals unsigned integers as lowercase hex strings prefixed with 0x, e.g. "0xff".
+	UintFormatHexPrefixed = "hexprefixed"
+)
+
+const (
+	// MapKeySortLexical sorts map keys lexically, which is the default.
+	MapKeySortLexical = "lexical"
+	// MapKeySortStableHash sorts map keys by their FNV-1a hash. The order is deterministic across processes and
+	// versions, but doesn't reveal the lexical structure of the keys, e.g. for pagination cursors.
+	MapKeySortStableHash = "stable-hash"
+)
+
+const (
+	// NameResolutionGroupOrder uses the key of the first requested group, in the order of Options.Groups,
+	// which is the default.
+	NameResolutionGroupOrder = "group-order"
+	// NameResolutionTagOrder uses the first key of the `rename` tag whose group is requested.
+	NameResolutionTagOrder = "tag-order"
+)
+
+// tagNames returns the configured tag names, falling back to the default names.
+func (o *Options) tagNames() tagNames {
+	names := tagNames{key: o.TagName, groups: o.GroupName, since: o.SinceName, until: o.UntilName}
+	if names.key == "" {
+		names.key = "json"
+	}
+	if names.groups == "" {
+		names.groups = "groups"
+	}
+	if names.since == "" {
+		names.since = "since"
+	}
+	if names.until == "" {
+		names.until = "until"
+	}
+	return names
+}
+
+// ErrTooManyFields is returned when an object exceeds Options.MaxFieldsPerObject.
+var ErrTooManyFields = errors.New("marshaller: too many fields")
+
+// ErrTooManyElements is returned when the output exceeds Options.MaxTotalElements.
+var ErrTooManyElements = errors.New("marshaller: too many elements")
+
+// ErrUnexpectedKeys is returned when the output contains keys which are not part of Options.AssertOnlyKeys.
+var ErrUnexpectedKeys = errors.New("marshaller: unexpected keys in output")
+
+// ErrDuplicateMapKey is returned when distinct keys of a map result in the same string, e.g. by a colliding fmt.Stringer.
+var ErrDuplicateMapKey = errors.New("marshaller: duplicate map key")
+
 // MarshalInvalidTypeError is an error returned to indicate the wrong type has been
 // passed to Marshal.
 type MarshalInvalidTypeError struct {
@@ -64,12 +509,70 @@ type MarshalInvalidTypeError struct {
 	t reflect.Kind
 	// data contains the passed data itself
 	data interface{}
+	// mapKey is set if the data is a map key which can't be converted to a string
+	mapKey bool
 }
 
 func (e MarshalInvalidTypeError) Error() string {
+	if e.mapKey {
+		return fmt.Sprintf("marshaller: unsupported map key type %T", e.data)
+	}
+	if isUnsupportedKind(e.t) {
+		return fmt.Sprintf("marshaller: Unable to marshal type %s. The kind is not supported by JSON.", e.t)
+	}
 	return fmt.Sprintf("marshaller: Unable to marshal type %s. Struct required.", e.t)
 }
 
+// isUnsupportedKind checks whether values of the kind can't be represented in JSON, encoding/json fails on them.
+func isUnsupportedKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Chan, reflect.Func, reflect.Complex64, reflect.Complex128, reflect.UnsafePointer:
+		return true
+	}
+	return false
+}
+
+// Kind returns the kind of the data which couldn't be marshalled.
+func (e MarshalInvalidTypeError) Kind() reflect.Kind {
+	return e.t
+}
+
+// Data returns the data which couldn't be marshalled.
+func (e MarshalInvalidTypeError) Data() interface{} {
+	return e.data
+}
+
+// MarshalFieldError wraps an error returned while marshalling a nested value and reports where it happened.
+type MarshalFieldError struct {
+	// Path is the path of the value, e.g. "user.addresses[2].zip". Struct fields use their json name.
+	Path string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *MarshalFieldError) Error() string {
+	return fmt.Sprintf("field %s: %s", e.Path, e.Err)
+}
+
+func (e *MarshalFieldError) Unwrap() error {
+	return e.Err
+}
+
+// wrapFieldError prefixes the path of err with the passed segment, wrapping err in a MarshalFieldError if it isn't
+// one yet. Segments of struct fields and map keys are joined with a dot, indexes are passed as e.g. "[2]".
+func wrapFieldError(err error, segment string) error {
+	fieldErr, ok := err.(*MarshalFieldError)
+	if !ok {
+		return &MarshalFieldError{Path: segment, Err: err}
+	}
+	if strings.HasPrefix(fieldErr.Path, "[") {
+		fieldErr.Path = segment + fieldErr.Path
+	} else {
+		fieldErr.Path = segment + "." + fieldErr.Path
+	}
+	return fieldErr
+}
+
 // Marshaller is the interface models have to implement in order to conform to marshalling.
 type Marshaller interface {
 	Marshal(options *Options) (interface{}, error)
@@ -79,28 +582,167 @@ type Marshaller interface {
 //
 // If the passed argument `data` is a struct, the return value will be of type `map[string]interface{}`.
 // In all other cases we can't derive the type in a meaningful way and is therefore an `interface{}`.
+//
+// The passed options are treated as read-only, the same options can therefore be shared across goroutines
+// calling Marshal concurrently.
+//
+// Marshal fails if the `,string` json option is used on a field whose type implements json.Marshaler or
+// encoding.TextMarshaler, e.g. time.Time or net.IP. encoding/json silently ignores the option on such fields.
 func Marshal(options *Options, data interface{}) (interface{}, error) {
+	// nested calls (e.g. by a Marshaller) continue with the state of the current call
+	if options.state != nil {
+		return marshal(options, data)
+	}
+	return marshalTopLevel(options, data)
+}
+
+// MarshalWithContext is like Marshal but passes the context to Options.ContextFieldFilter.
+// Marshallers can access the context using Options.Context.
+func MarshalWithContext(ctx context.Context, options *Options, data interface{}) (interface{}, error) {
+	c := *options
+	c.ctx = ctx
+	return Marshal(&c, data)
+}
+
+// Context returns the context passed to MarshalWithContext, or context.Background() if there is none.
+func (o *Options) Context() context.Context {
+	if o.ctx == nil {
+		return context.Background()
+	}
+	return o.ctx
+}
+
+// Clone returns a copy of the options, whose slices and maps can be modified without affecting the original.
+// The functions and the ApiVersion are shared with the original. The state of a running Marshal call isn't copied,
+// which allows to keep prototype options and clone them per request.
+func (o *Options) Clone() *Options {
+	c := *o
+	c.state = nil
+	c.Groups = cloneStrings(o.Groups)
+	c.DefaultGroups = cloneStrings(o.DefaultGroups)
+	c.FallbackGroups = cloneStrings(o.FallbackGroups)
+	c.DenyGroups = cloneStrings(o.DenyGroups)
+	c.ReservedKeys = cloneStrings(o.ReservedKeys)
+	c.AssertOnlyKeys = cloneStrings(o.AssertOnlyKeys)
+	c.GroupAliases = cloneStringsMap(o.GroupAliases)
+	c.GroupKeyDeny = cloneStringsMap(o.GroupKeyDeny)
+	if o.ValueRedactors != nil {
+		c.ValueRedactors = append([]ValueRedactor(nil), o.ValueRedactors...)
+	}
+	if o.EmptyDefinitions != nil {
+		c.EmptyDefinitions = make(map[reflect.Kind]func(reflect.Value) bool, len(o.EmptyDefinitions))
+		for k, v := range o.EmptyDefinitions {
+			c.EmptyDefinitions[k] = v
+		}
+	}
+	if o.TypeMarshallers != nil {
+		c.TypeMarshallers = make(map[reflect.Type]func(value interface{}) (interface{}, error), len(o.TypeMarshallers))
+		for k, v := range o.TypeMarshallers {
+			c.TypeMarshallers[k] = v
+		}
+	}
+	if o.ComputedFields != nil {
+		c.ComputedFields = make(map[reflect.Type][]ComputedField, len(o.ComputedFields))
+		for k, v := range o.ComputedFields {
+			c.ComputedFields[k] = append([]ComputedField(nil), v...)
+		}
+	}
+	return &c
+}
+
+// cloneStrings copies the slice, keeping nil slices nil.
+func cloneStrings(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// cloneStringsMap copies the map as well as its slices.
+func cloneStringsMap(m map[string][]string) map[string][]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string][]string, len(m))
+	for k, v := range m {
+		c[k] = cloneStrings(v)
+	}
+	return c
+}
+
+// marshalTopLevel starts a new Marshal call.
+// The passed options are never modified, the call operates on its own copy carrying the state of the call.
+func marshalTopLevel(options *Options, data interface{}) (interface{}, error) {
 	v := reflect.ValueOf(data)
-	if !v.IsValid() || v.Kind() == reflect.Ptr && v.IsNil() {
-		return data, nil
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
 	}
-	t := v.Type()
+	if canMarshalParallel(options, v) {
+		dest, err := marshalParallel(options, v)
+		if err != nil {
+			return nil, err
+		}
+		state := options.withState()
+		return redactTopLevel(state, compactTopLevel(state, dest)), nil
+	}
+
+	state := options.withState()
+	dest, err := marshal(state, data)
+	if err != nil {
+		return nil, err
+	}
+	dest = redactTopLevel(state, compactTopLevel(state, dest))
 
-	// Initialise nestedGroupsMap,
-	// TODO: this may impact the performance, find a better place for this.
-	if options.nestedGroupsMap == nil {
-		options.nestedGroupsMap = make(map[string][]string)
+	if store, ok := dest.(KVStore); ok {
+		// fall back to the FallbackGroups if the requested groups don't match any field
+		if len(options.FallbackGroups) > 0 && kvStoreLen(store) == 0 {
+			fallback := *options
+			fallback.Groups = options.FallbackGroups
+			fallback.FallbackGroups = nil
+			for k := range fallback.omitted {
+				delete(fallback.omitted, k)
+			}
+			return marshalTopLevel(&fallback, data)
+		}
+
+		if err := assertOnlyKeys(options, store); err != nil {
+			return nil, err
+		}
+
+		if options.EmitVersionField != "" && options.ApiVersion != nil && v.Kind() == reflect.Struct {
+			store.Set(options.EmitVersionField, options.ApiVersion.String())
+		}
 	}
 
-	if options.FieldFilter == nil {
-		options.FieldFilter = createDefaultFieldFilter(options)
+	return dest, nil
+}
+
+// assertOnlyKeys returns an error listing the keys of the passed object which are not part of options.AssertOnlyKeys.
+func assertOnlyKeys(options *Options, dest KVStore) error {
+	if options.AssertOnlyKeys == nil {
+		return nil
 	}
 
-	if options.KVStoreFactory == nil {
-		options.KVStoreFactory = func() KVStore {
-			return kvStore{}
+	var unexpected []string
+	dest.Each(func(k string, _ interface{}) {
+		if !contains(k, options.AssertOnlyKeys) {
+			unexpected = append(unexpected, k)
 		}
+	})
+	if len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		return fmt.Errorf("%w: %s", ErrUnexpectedKeys, strings.Join(unexpected, ", "))
+	}
+	return nil
+}
+
+// marshal encodes the passed data using the options carrying the state of the current call.
+func marshal(options *Options, data interface{}) (interface{}, error) {
+	v := reflect.ValueOf(data)
+	if !v.IsValid() || v.Kind() == reflect.Ptr && v.IsNil() {
+		return data, nil
 	}
+	t := v.Type()
 
 	if t.Kind() == reflect.Ptr {
 		// follow pointer
@@ -115,43 +757,58 @@ func Marshal(options *Options, data interface{}) (interface{}, error) {
 		return marshalValue(options, v)
 	}
 
+	// only addressable structs can be part of a cycle, others are copies
+	if v.CanAddr() {
+		visit := visitKey{ptr: v.UnsafeAddr(), t: t}
+		if err := options.state.enter(visit); err != nil {
+			return nil, err
+		}
+		defer options.state.leave(visit)
+	}
+
+	if options.OnType != nil && options.state.seenTypes.add(t) {
+		options.OnType(t)
+	}
+
+	if options.ValidateBeforeMarshal {
+		if err := validateStruct(v); err != nil {
+			return nil, err
+		}
+	}
+
 	dest := options.KVStoreFactory()
 
-	for i := 0; i < t.NumField(); i++ {
-		field := t.Field(i)
+	parent := v
+	ti := typeInfoOf(options, t)
+	for i := range ti.fields {
+		fi := &ti.fields[i]
+		field := fi.field
 		val := v.Field(i)
 
-		jsonTagVal, jsonTagExists := field.Tag.Lookup("json")
-		jsonTag, jsonOpts := parseTag(jsonTagVal)
-
-		// If no json tag is provided, use the field Name
-		if jsonTag == "" {
-			jsonTag = field.Name
+		if fi.skip {
+			omitField(options, fi, OmitReasonTag)
+			continue
 		}
-
-		if jsonTag == "-" {
+		if fi.omitEmpty && isEmpty(options, val) {
+			omitField(options, fi, OmitReasonOmitEmpty)
 			continue
 		}
-		if jsonOpts.Contains("omitempty") && isEmptyValue(val) {
+		if options.OmitDefaults && val.IsZero() {
+			omitField(options, fi, OmitReasonOmitDefaults)
 			continue
 		}
+		// omitempty_groups restricts omitempty to the listed groups
+		if fi.omitEmptyGroups != nil && isEmpty(options, val) {
+			if listContains(fi.omitEmptyGroups, options.Groups, options.CaseInsensitiveGroups) {
+				omitField(options, fi, OmitReasonOmitEmptyGroups)
+				continue
+			}
+		}
 		// skip unexported fields
 		if !val.IsValid() || !val.CanInterface() {
 			continue
 		}
 
-		quoted := false
-		if jsonOpts.Contains("string") {
-			switch val.Kind() {
-			case reflect.Bool,
-				reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
-				reflect.Float32, reflect.Float64,
-				reflect.String:
-				quoted = true
-			}
-		}
-
 		// if there is an anonymous field which is a struct
 		// we want the childs exposed at the toplevel to be
 		// consistent with the embedded json marshaller
@@ -162,72 +819,400 @@ func Marshal(options *Options, data interface{}) (interface{}, error) {
 		// we can skip the group checkif if the field is a composition field
 		isEmbeddedField := field.Anonymous && val.Kind() == reflect.Struct
 
-		if isEmbeddedField && field.Type.Kind() == reflect.Struct {
-			tt := field.Type
-			parentGroups := strings.Split(field.Tag.Get("groups"), ",")
-			for i := 0; i < tt.NumField(); i++ {
-				nestedField := tt.Field(i)
-				options.nestedGroupsMap[nestedField.Name] = parentGroups
-			}
+		include, err := selectField(options, fi, parent.Field(i), isEmbeddedField)
+		if err != nil {
+			return nil, err
 		}
-
-		if !isEmbeddedField {
-			include, err := options.FieldFilter(field)
-			if err != nil {
-				return nil, err
-			}
-
-			if !include {
-				// skip this field
-				continue
+		if !include {
+			// skip this field
+			// the reason re-runs the filters, it's only determined by MarshalDebug
+			if options.state.debug != nil {
+				omitField(options, fi, filterReason(options, fi))
 			}
+			options.state.filtered++
+			continue
+		}
 
+		var (
+			v         interface{}
+			truncated bool
+			quoted    bool
+		)
+		key := outputKey(options, fi)
+		if err := countElement(options); err != nil {
+			return nil, wrapFieldError(err, key)
 		}
 
-		v, err := marshalValue(options, val)
+		inheritedGroups := inheritFieldGroups(options, fi, isEmbeddedField)
+		filtered := options.state.filtered
+		options.state.enterPath(key)
+		if options.Redact && fi.redact {
+			v = redactField(options, field)
+		} else if d, ok := fi.groupDefaultValue(options); ok {
+			v = d
+		} else if fi.via != "" {
+			v, err = marshalVia(options, parent, fi, parent.Field(i))
+		} else if m, ok := options.TypeMarshallers[field.Type]; ok {
+			v, err = m(parent.Field(i).Interface())
+		} else {
+			v, truncated, err = marshalField(options, fi, val)
+			// the string option only applies to the plain value, not to e.g. a formatted number
+			quoted = fi.quoted && !replacesScalar(options, val)
+		}
+		options.state.inheritedGroups = inheritedGroups
+		options.state.leavePath()
 		if err != nil {
-			return nil, err
+			return nil, wrapFieldError(err, key)
+		}
+		if options.NilInterfaceAsEmptyObject && field.Type.Kind() == reflect.Interface && val.IsNil() {
+			v = options.KVStoreFactory()
+		}
+		if options.ValueTransformer != nil && isLeaf(v) {
+			if v, err = options.ValueTransformer(field, v); err != nil {
+				return nil, wrapFieldError(err, key)
+			}
 		}
 		if quoted {
-			v = fmt.Sprintf("%v", v)
+			if v, err = quoteValue(v); err != nil {
+				return nil, wrapFieldError(err, key)
+			}
 		}
 
 		// when a composition field we want to bring the child
-		// nodes to the top
+		// nodes to the top. If the embedded field doesn't result in
+		// a KVStore or a map[string]interface{} (e.g. a Marshaller
+		// returning a scalar) it is set under the field's key instead.
 		nestedVal, ok := v.(KVStore)
-		if !jsonTagExists && isEmbeddedField && ok {
+		if m, isMap := v.(map[string]interface{}); isMap && isEmbeddedField && !fi.hasJSONName {
+			nestedVal, ok = kvStore(m), true
+		}
+		if options.OmitDefaults && ok && val.Kind() == reflect.Struct && kvStoreLen(nestedVal) == 0 {
+			options.state.omit(key, OmitReasonOmitDefaults)
+			continue
+		}
+		if options.OmitEmptyStructs && fi.omitEmpty && ok && isStruct(val) && kvStoreLen(nestedVal) == 0 {
+			options.state.omit(key, OmitReasonOmitEmpty)
+			continue
+		}
+		// only objects which lost fields to the filter are dropped, structs without fields are kept
+		if options.OmitEmptyNested && ok && isStruct(val) && kvStoreLen(nestedVal) == 0 && options.state.filtered > filtered {
+			options.state.omit(key, OmitReasonEmptyNested)
+			continue
+		}
+		if !fi.hasJSONName && isEmbeddedField && ok {
 			nestedVal.Each(func(k string, v interface{}) {
-				dest.Set(k, v)
+				// the keys of flattened structs have been checked already, those of Marshallers haven't
+				if isKeyDenied(options, k) {
+					options.state.omit(k, OmitReasonDeniedKey)
+					return
+				}
+				setFlattened(options, dest, k, v)
 			})
+		} else if isKeyDenied(options, key) {
+			options.state.omit(key, OmitReasonDeniedKey)
 		} else {
-			dest.Set(jsonTag, v)
+			setFlattened(options, dest, key, v)
+		}
+		if truncated && options.MarkTruncated {
+			markTruncated(options, dest, key)
 		}
 	}
 
+	if err := addComputedFields(options, t, v, dest); err != nil {
+		return nil, err
+	}
+	if err := checkMaxFields(options, dest); err != nil {
+		return nil, err
+	}
+
 	return dest, nil
 }
 
-// createDefaultFieldFilter creates a default FieldFilter function which uses the options.Groups and options.ApiVersion
-// fields in order to determine whether a field should be marshalled or not.
-func createDefaultFieldFilter(options *Options) FieldFilter {
+// selectField determines whether the field is marshalled, it's shared with Unmarshal so both select the same fields.
+// Embedded structs are always selected, their groups are propagated to their fields instead.
+func selectField(options *Options, fi *fieldInfo, val reflect.Value, isEmbeddedField bool) (bool, error) {
+	if !isEmbeddedField {
+		return filterField(options, fi, val)
+	}
+	if t := fi.field.Type; t.Kind() == reflect.Struct && !options.DisableEmbeddedGroupInheritance {
+		if options.state.nestedGroupsMap == nil {
+			options.state.nestedGroupsMap = make(map[string][]string)
+		}
+		for i := 0; i < t.NumField(); i++ {
+			options.state.nestedGroupsMap[t.Field(i).Name] = fi.parentGroups
+		}
+	}
+	return true, nil
+}
+
+// inheritFieldGroups makes the untagged fields of the value of a named field inherit its groups,
+// see Options.InheritFieldGroups. It returns the previously inherited groups, which have to be restored
+// once the value has been processed.
+func inheritFieldGroups(options *Options, fi *fieldInfo, isEmbeddedField bool) []string {
+	inherited := options.state.inheritedGroups
+	if (options.InheritFieldGroups || fi.inheritGroups) && fi.hasGroups && !isEmbeddedField {
+		options.state.inheritedGroups = fi.parentGroups
+	}
+	return inherited
+}
+
+// setFlattened sets the key of dest. With options.DeepMergeFlattenedMaps, an object colliding with an object
+// already set, e.g. by a flattened embedded struct, is merged into it instead of replacing it.
+func setFlattened(options *Options, dest KVStore, key string, v interface{}) {
+	if options.DeepMergeFlattenedMaps {
+		if src, ok := v.(KVStore); ok {
+			if existing, ok := kvStoreGet(dest, key).(KVStore); ok {
+				mergeKVStores(existing, src)
+				return
+			}
+		}
+	}
+	dest.Set(key, v)
+}
+
+// mergeKVStores deep-merges src into dest, the values of src win unless both values are objects.
+func mergeKVStores(dest, src KVStore) {
+	src.Each(func(k string, v interface{}) {
+		if s, ok := v.(KVStore); ok {
+			if d, ok := kvStoreGet(dest, k).(KVStore); ok {
+				mergeKVStores(d, s)
+				return
+			}
+		}
+		dest.Set(k, v)
+	})
+}
+
+// kvStoreGet returns the value of the key in the store, or nil if it isn't set.
+func kvStoreGet(store KVStore, key string) interface{} {
+	var value interface{}
+	store.Each(func(k string, v interface{}) {
+		if k == key {
+			value = v
+		}
+	})
+	return value
+}
+
+// quoteValue implements the `,string` json option: the value is encoded as JSON and the result is used as a string,
+// exactly like encoding/json does. A string is therefore quoted twice, nil stays null.
+// It's only applied to the value marshalled from the field, values replaced e.g. by the redaction or the
+// `default_groups` tag are emitted as they are. The option is ignored for non-scalar kinds, using it on a type
+// implementing json.Marshaler or encoding.TextMarshaler like time.Time results in an error instead of silently
+// ignoring it.
+func quoteValue(d interface{}) (interface{}, error) {
+	if d == nil {
+		return nil, nil
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// replacesScalar checks whether marshalValue replaces the scalar v by the output of the TypeMarshallers,
+// the UintFormat or the NumberFormatter. The `,string` json option isn't applied to such values.
+func replacesScalar(options *Options, v reflect.Value) bool {
+	if !v.IsValid() {
+		return false
+	}
+	if _, ok := typeMarshaller(options, v); ok {
+		return true
+	}
+	k := v.Kind()
+	if options.UintFormat != "" && options.UintFormat != UintFormatDec && isUintKind(k) {
+		return true
+	}
+	return options.NumberFormatter != nil && isNumberKind(k)
+}
+
+// validator is implemented by types which can check their own consistency, see Options.ValidateBeforeMarshal.
+type validator interface {
+	Validate() error
+}
+
+// validateStruct calls the Validate method of the struct v if it or its pointer implements validator.
+func validateStruct(v reflect.Value) error {
+	if val, ok := v.Interface().(validator); ok {
+		return val.Validate()
+	}
+	if v.CanAddr() {
+		if val, ok := v.Addr().Interface().(validator); ok {
+			return val.Validate()
+		}
+	}
+	return nil
+}
+
+// isLeaf checks whether the marshalled value d isn't a nested object or slice.
+func isLeaf(d interface{}) bool {
+	switch d.(type) {
+	case KVStore, []interface{}:
+		return false
+	}
+	return true
+}
+
+// isEmpty checks whether the value is empty for the `omitempty` json option and the `omitempty_groups` tag,
+// using options.EmptyDefinitions for its kind if there is one. Absent optionals are empty with options.UnwrapOptionals.
+func isEmpty(options *Options, v reflect.Value) bool {
+	if options.UnwrapOptionals {
+		if _, present, ok := unwrapOptional(v); ok {
+			return !present
+		}
+	}
+	if isEmpty, ok := options.EmptyDefinitions[v.Kind()]; ok {
+		return isEmpty(v)
+	}
+	return isEmptyValue(v)
+}
+
+// redactedPlaceholder is the default value of fields masked by Options.Redact.
+const redactedPlaceholder = "[REDACTED]"
+
+// redactField returns the value replacing a field tagged with `redact:"true"`.
+func redactField(options *Options, field reflect.StructField) interface{} {
+	if options.RedactWith != nil {
+		return options.RedactWith(field)
+	}
+	return redactedPlaceholder
+}
+
+// outputKey returns the key of the field in the output, prefixing it if it's one of options.ReservedKeys.
+func outputKey(options *Options, fi *fieldInfo) string {
+	return reserveKey(options, fi.key(options))
+}
+
+// reserveKey prefixes the key if it's one of options.ReservedKeys.
+func reserveKey(options *Options, key string) string {
+	if len(options.ReservedKeys) > 0 && contains(key, options.ReservedKeys) {
+		prefix := options.ReservedPrefix
+		if prefix == "" {
+			prefix = defaultReservedPrefix
+		}
+		return prefix + key
+	}
+	return key
+}
+
+// markTruncated adds the `<key>_truncated` key of Options.MarkTruncated to dest. The key is checked like the keys of
+// fields, it's prefixed if it's reserved and skipped if it's denied. A field with the same key wins over it.
+func markTruncated(options *Options, dest KVStore, key string) {
+	marker := reserveKey(options, key+"_truncated")
+	if isKeyDenied(options, marker) {
+		options.state.omit(marker, OmitReasonDeniedKey)
+		return
+	}
+	if kvStoreHas(dest, marker) {
+		return
+	}
+	dest.Set(marker, true)
+}
+
+// defaultReservedPrefix is the prefix of reserved keys if Options.ReservedPrefix isn't set.
+const defaultReservedPrefix = "_"
+
+// isKeyDenied checks whether the key matches one of the patterns of Options.GroupKeyDeny for the requested groups.
+func isKeyDenied(options *Options, key string) bool {
+	for _, pattern := range options.state.deniedKeys {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMaxFields returns an error if the passed object exceeds options.MaxFieldsPerObject.
+func checkMaxFields(options *Options, dest KVStore) error {
+	if options.MaxFieldsPerObject <= 0 {
+		return nil
+	}
+	if l := kvStoreLen(dest); l > options.MaxFieldsPerObject {
+		return fmt.Errorf("%w: object has %d fields, limit is %d", ErrTooManyFields, l, options.MaxFieldsPerObject)
+	}
+	return nil
+}
+
+// countElement counts an emitted value against options.MaxTotalElements.
+func countElement(options *Options) error {
+	if options.MaxTotalElements <= 0 {
+		return nil
+	}
+	if n := atomic.AddInt64(options.state.elements, 1); n > int64(options.MaxTotalElements) {
+		return fmt.Errorf("%w: limit is %d", ErrTooManyElements, options.MaxTotalElements)
+	}
+	return nil
+}
+
+// filterField determines whether the field should be marshalled.
+// The default filter works on the cached field information, custom filters are passed the struct field.
+func filterField(options *Options, fi *fieldInfo, val reflect.Value) (bool, error) {
+	if options.ContextFieldFilter != nil {
+		return options.ContextFieldFilter(options.Context(), fi.field)
+	}
+	if options.ValueFieldFilter != nil {
+		return options.ValueFieldFilter(fi.field, val)
+	}
+	if options.FieldFilter != nil {
+		return options.FieldFilter(fi.field)
+	}
+	return defaultFilter(options, fi)
+}
+
+// defaultFilter implements the default FieldFilter based on the parsed tags of the field.
+func defaultFilter(options *Options, fi *fieldInfo) (bool, error) {
+	if !groupsFilter(options, fi) {
+		return false, nil
+	}
+	return versionFilter(options, fi)
+}
+
+// groupsFilter checks whether the field passes the group options.
+func groupsFilter(options *Options, fi *fieldInfo) bool {
 	checkGroups := len(options.Groups) > 0
+	checkDenyGroups := len(options.DenyGroups) > 0
+	fold := options.CaseInsensitiveGroups
+
+	if checkGroups || checkDenyGroups {
+		groups, minGroups, negatedGroups := fi.groups, fi.minGroups, fi.negatedGroups
+		if !fi.hasGroups && options.state.nestedGroupsMap[fi.field.Name] != nil {
+			groups, minGroups = parseGroupsModifier(options.state.nestedGroupsMap[fi.field.Name])
+			groups, negatedGroups = splitNegatedGroups(groups)
+		} else if !fi.hasGroups && options.state.inheritedGroups != nil {
+			groups, minGroups = parseGroupsModifier(options.state.inheritedGroups)
+			groups, negatedGroups = splitNegatedGroups(groups)
+		}
+
+		// Denied groups win over requested groups
+		if checkDenyGroups && listContains(groups, options.DenyGroups, fold) {
+			// skip this field
+			return false
+		}
 
-	return func(field reflect.StructField) (bool, error) {
 		if checkGroups {
-			var groups []string
-			if field.Tag.Get("groups") != "" {
-				groups = strings.Split(field.Tag.Get("groups"), ",")
+			// Negated groups (e.g. `groups:"api,!internal"`) win over requested groups
+			if listContains(negatedGroups, options.Groups, fold) {
+				// skip this field
+				return false
 			}
 
-			if len(groups) == 0 && options.nestedGroupsMap[field.Name] != nil {
-				groups = append(groups, options.nestedGroupsMap[field.Name]...)
+			matches := listContains(groups, options.Groups, fold)
+			if minGroups > 1 {
+				matches = countContains(groups, options.Groups, fold) >= minGroups
+			}
+			if len(groups) > 0 && contains(wildcardGroup, options.Groups) {
+				matches = true
+			}
+			if options.MatchAllGroups {
+				matches = len(groups) > 0 && containsAll(groups, options.Groups, fold)
 			}
 
 			// Marshall the field if
-			// - it has at least one of the requested groups
+			// - it has at least one (or the minimum count) of the requested groups
 			//     or
 			// - it has no group and 'IncludeEmptyTag' is set to true
-			shouldShow := listContains(groups, options.Groups) || (len(groups) == 0 && options.IncludeEmptyTag)
+			shouldShow := matches || (len(groups) == 0 && options.IncludeEmptyTag)
 
 			// Prevent marshalling of the field if
 			// - it should not be shown (above)
@@ -237,39 +1222,128 @@ func createDefaultFieldFilter(options *Options) FieldFilter {
 
 			if shouldHide {
 				// skip this field
-				return false, nil
+				return false
 			}
 		}
+	}
+	return true
+}
 
-		if since := field.Tag.Get("since"); since != "" {
-			sinceVersion, err := version.NewVersion(since)
-			if err != nil {
-				return true, err
-			}
-			if options.ApiVersion.LessThan(sinceVersion) {
-				// skip this field
-				return false, nil
-			}
+// versionFilter checks whether the field passes the version options.
+func versionFilter(options *Options, fi *fieldInfo) (bool, error) {
+	apiVersion := options.state.apiVersion
+	if fi.constraintErr != nil {
+		return true, fi.constraintErr
+	}
+	if fi.constraint != nil {
+		if apiVersion == nil {
+			return true, fmt.Errorf("sheriff: field %s has version tag but Options.ApiVersion is nil", fi.field.Name)
 		}
+		// the constraint takes precedence over since and until
+		return fi.constraint.Check(apiVersion), nil
+	}
 
-		if until := field.Tag.Get("until"); until != "" {
-			untilVersion, err := version.NewVersion(until)
-			if err != nil {
-				return true, err
-			}
-			if options.ApiVersion.GreaterThan(untilVersion) {
-				// skip this field
-				return false, nil
+	if fi.sinceErr != nil {
+		return true, fi.sinceErr
+	}
+	if (fi.since != nil || fi.until != nil) && apiVersion == nil {
+		return true, fmt.Errorf("sheriff: field %s has since/until tag but Options.ApiVersion is nil", fi.field.Name)
+	}
+	if fi.since != nil && apiVersion.LessThan(fi.since) {
+		// skip this field
+		return false, nil
+	}
+
+	if fi.untilErr != nil {
+		return true, fi.untilErr
+	}
+	if fi.until != nil && apiVersion.GreaterThan(fi.until) {
+		// skip this field
+		return false, nil
+	}
+	if fi.until != nil && options.ExclusiveUntil && apiVersion.Equal(fi.until) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// marshalField marshals the value of a struct field, taking the field specific tags into account.
+// The second return value reports whether a slice has been truncated because of the `maxitems` tag
+// or options.DefaultMaxItems.
+func marshalField(options *Options, fi *fieldInfo, val reflect.Value) (interface{}, bool, error) {
+	if fi.quotedErr != nil {
+		return nil, false, fi.quotedErr
+	}
+	if fi.rawJSON && val.IsValid() && val.Kind() == reflect.String {
+		if val.Len() == 0 {
+			// an empty string holds no JSON at all
+			return nil, false, nil
+		}
+		raw := json.RawMessage(val.String())
+		if !json.Valid(raw) {
+			return nil, false, errors.New("marshaller: invalid raw JSON")
+		}
+		return raw, false, nil
+	}
+	if fi.timeFormat != "" && val.IsValid() && val.CanInterface() {
+		if t, ok := asTime(val.Interface()); ok {
+			if formatted, ok := marshalTime(options, fi.timeFormat, t); ok {
+				return formatted, false, nil
 			}
 		}
+	}
+	isList := val.IsValid() && (val.Kind() == reflect.Slice && !val.IsNil() || val.Kind() == reflect.Array)
+	if isList && val.CanInterface() && !isSelfMarshalling(val) && !isByteSlice(val) {
+		maxItems := options.DefaultMaxItems
+		if fi.maxItemsErr != nil {
+			return nil, false, fi.maxItemsErr
+		}
+		if fi.hasMaxItems {
+			maxItems = fi.maxItems
+		}
+		return marshalSlice(options, val, maxItems)
+	}
 
-		return true, nil
+	v, err := marshalValue(options, val)
+	return v, false, err
+}
+
+// binaryMarshaler returns the value or its pointer if it implements encoding.BinaryMarshaler and is a scalar.
+// encoding/json doesn't call MarshalBinary, structs, slices, arrays and maps implementing it are therefore filtered
+// like any other value instead of being passed through with all of their fields.
+func binaryMarshaler(v reflect.Value) (interface{}, bool) {
+	if !isScalarKind(indirectType(v.Type()).Kind()) {
+		return nil, false
+	}
+	if v.Type().Implements(binaryMarshalerType) {
+		return v.Interface(), true
 	}
+	if v.CanAddr() && reflect.PointerTo(v.Type()).Implements(binaryMarshalerType) {
+		return v.Addr().Interface(), true
+	}
+	return nil, false
+}
+
+// isSelfMarshalling checks whether the value or its pointer implement one of the interfaces
+// which make sheriff pass the value through instead of marshalling it itself.
+func isSelfMarshalling(v reflect.Value) bool {
+	if implementsSelfMarshalling(v.Type()) || v.CanAddr() && implementsSelfMarshalling(reflect.PointerTo(v.Type())) {
+		return true
+	}
+	_, ok := binaryMarshaler(v)
+	return ok
+}
+
+// implementsSelfMarshalling checks the type instead of the value, boxing every value would allocate.
+func implementsSelfMarshalling(t reflect.Type) bool {
+	return t.Implements(marshallerType) || t.Implements(jsonMarshalerType) ||
+		t.Implements(textMarshalerType) || t.Implements(stringerType)
 }
 
 // marshalValue is being used for getting the actual value of a field.
 //
-// There is support for types implementing the Marshaller interface, arbitrary structs, slices, maps and base types.
+// There is support for types implementing the Marshaller interface, arbitrary structs, slices, arrays, maps and base types.
 func marshalValue(options *Options, v reflect.Value) (interface{}, error) {
 	// return nil on nil pointer struct fields
 	if !v.IsValid() || !v.CanInterface() {
@@ -277,15 +1351,41 @@ func marshalValue(options *Options, v reflect.Value) (interface{}, error) {
 	}
 	val := v.Interface()
 
+	if m, ok := typeMarshaller(options, v); ok {
+		return m(val)
+	}
 	if marshaller, ok := val.(Marshaller); ok {
 		return marshaller.Marshal(options)
 	}
+	if t, ok := asTime(val); ok {
+		if formatted, ok := marshalTime(options, "", t); ok {
+			return formatted, nil
+		}
+	}
+
+	k := v.Kind()
+
+	switch k {
+	case reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		if v.IsNil() {
+			return val, nil
+		}
+	}
+
+	// KVStore values are re-created using the KVStoreFactory in order to keep their ordering.
+	// This is checked before the self-marshalling types as e.g. the ordered KVStore implements json.Marshaler,
+	// the values it holds need to be filtered nonetheless.
+	if store, ok := val.(KVStore); ok {
+		return marshalKVStore(options, store)
+	}
+
 	// types which are e.g. structs, slices or maps and implement one of the following interfaces should not be
 	// marshalled by sheriff because they'll be correctly marshalled by json.Marshal instead.
 	// Otherwise (e.g. net.IP) a byte slice may be output as a list of uints instead of as an IP string.
 	// This needs to be checked for both value and pointer types.
+	// json.Number is passed through as well in order to be emitted as a number instead of a string.
 	switch val.(type) {
-	case json.Marshaler, encoding.TextMarshaler, fmt.Stringer:
+	case json.Marshaler, encoding.TextMarshaler, fmt.Stringer, json.Number:
 		return val, nil
 	}
 
@@ -297,57 +1397,158 @@ func marshalValue(options *Options, v reflect.Value) (interface{}, error) {
 			return addrVal, nil
 		}
 	}
-
-	k := v.Kind()
-
-	switch k {
-	case reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
-		if v.IsNil() {
-			return val, nil
-		}
+	if bm, ok := binaryMarshaler(v); ok {
+		return bm, nil
 	}
 
 	if k == reflect.Ptr {
 		v = v.Elem()
+		if v.Kind() == reflect.Ptr {
+			// pointers to pointers are dereferenced level by level, a nil level results in null
+			if v.IsNil() {
+				return nil, nil
+			}
+			return marshalValue(options, v)
+		}
 		val = v.Interface()
 		k = v.Kind()
 	}
 
-	if k == reflect.Interface || k == reflect.Struct {
-		return Marshal(options, val)
-	}
-	if k == reflect.Slice {
-		l := v.Len()
-		dest := make([]interface{}, l)
-		for i := 0; i < l; i++ {
-			d, err := marshalValue(options, v.Index(i))
-			if err != nil {
-				return nil, err
+	// fail right away instead of returning a value which encoding/json fails on later
+	if isUnsupportedKind(k) {
+		return nil, MarshalInvalidTypeError{t: k, data: val}
+	}
+
+	if options.UnwrapOptionals {
+		if inner, present, ok := unwrapOptional(v); ok {
+			if !present {
+				return nil, nil
 			}
-			dest[i] = d
+			return marshalValue(options, inner)
 		}
-		return dest, nil
+	}
+
+	if k == reflect.Struct && v.CanAddr() {
+		// keep the struct addressable for the cycle detection
+		return marshal(options, v.Addr().Interface())
+	}
+	if k == reflect.Interface || k == reflect.Struct {
+		return marshal(options, val)
+	}
+	if isByteSlice(v) {
+		return val, nil
+	}
+	if k == reflect.Slice || k == reflect.Array {
+		dest, _, err := marshalSlice(options, v, options.DefaultMaxItems)
+		return dest, err
 	}
 	if k == reflect.Map {
-		mapKeys := v.MapKeys()
-		if len(mapKeys) == 0 {
-			return val, nil
+		return marshalMap(options, v)
+	}
+	if options.UintFormat != "" && options.UintFormat != UintFormatDec && isUintKind(k) {
+		return formatUint(options.UintFormat, v.Uint())
+	}
+	if options.NumberFormatter != nil && isNumberKind(k) {
+		return options.NumberFormatter(k, val)
+	}
+	return val, nil
+}
+
+// typeMarshaller returns the function of options.TypeMarshallers for the type of v,
+// or for the concrete type of the value if v is an interface.
+func typeMarshaller(options *Options, v reflect.Value) (func(value interface{}) (interface{}, error), bool) {
+	if len(options.TypeMarshallers) == 0 {
+		return nil, false
+	}
+	if m, ok := options.TypeMarshallers[v.Type()]; ok {
+		return m, true
+	}
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		m, ok := options.TypeMarshallers[v.Elem().Type()]
+		return m, ok
+	}
+	return nil, false
+}
+
+// isNumberKind checks whether the passed kind is an integer or floating point number.
+func isNumberKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// isScalarKind checks whether the passed kind is a bool, a number or a string.
+func isScalarKind(k reflect.Kind) bool {
+	return k == reflect.Bool || k == reflect.String || isNumberKind(k)
+}
+
+// isUintKind checks whether the passed kind is an unsigned integer, uintptr is not considered to be one.
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// formatUint formats the unsigned integer according to the passed Options.UintFormat.
+func formatUint(format string, u uint64) (interface{}, error) {
+	switch format {
+	case UintFormatHex:
+		return strconv.FormatUint(u, 16), nil
+	case UintFormatHexPrefixed:
+		return "0x" + strconv.FormatUint(u, 16), nil
+	}
+	return nil, fmt.Errorf("marshaller: unknown UintFormat %q", format)
+}
+
+// isStruct checks whether v is a struct or a non-nil pointer to one.
+func isStruct(v reflect.Value) bool {
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v.Kind() == reflect.Struct
+}
+
+// isByteSlice checks whether v is a byte slice, which is passed through in order to be encoded as base64 by encoding/json.
+func isByteSlice(v reflect.Value) bool {
+	return v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8
+}
+
+// keysOrderer is implemented by map types which define the order of their keys.
+type keysOrderer interface {
+	Keys() []string
+}
+
+// marshalKVStore marshals every value of the passed KVStore into a new KVStore, keeping the iteration order.
+func marshalKVStore(options *Options, store KVStore) (interface{}, error) {
+	dest := options.KVStoreFactory()
+	var err error
+	store.Each(func(k string, v interface{}) {
+		if err != nil {
+			return
 		}
-		if mapKeys[0].Kind() != reflect.String {
-			return nil, MarshalInvalidTypeError{t: mapKeys[0].Kind(), data: val}
+		if isKeyDenied(options, k) {
+			options.state.omit(k, OmitReasonDeniedKey)
+			return
 		}
-
-		dest := options.KVStoreFactory()
-		for _, key := range mapKeys {
-			d, err := marshalValue(options, v.MapIndex(key))
-			if err != nil {
-				return nil, err
-			}
-			dest.Set(key.String(), d)
+		var d interface{}
+		if d, err = marshalValue(options, reflect.ValueOf(v)); err != nil {
+			err = wrapFieldError(err, k)
 		}
-		return dest, nil
+		dest.Set(k, d)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return val, nil
+	if err := checkMaxFields(options, dest); err != nil {
+		return nil, err
+	}
+	return dest, nil
 }
 
 // contains check if a given key is contained in a slice of strings.
@@ -360,11 +1561,24 @@ func contains(key string, list []string) bool {
 	return false
 }
 
+// containsGroup checks whether the group is part of groups, ignoring the case if fold is set.
+func containsGroup(group string, groups []string, fold bool) bool {
+	if !fold {
+		return contains(group, groups)
+	}
+	for _, g := range groups {
+		if strings.EqualFold(group, g) {
+			return true
+		}
+	}
+	return false
+}
+
 // listContains operates on two string slices and checks if one of the strings in `a`
-// is contained in `b`.
-func listContains(a []string, b []string) bool {
+// is contained in `b`, ignoring the case if fold is set.
+func listContains(a []string, b []string, fold bool) bool {
 	for _, key := range a {
-		if contains(key, b) {
+		if containsGroup(key, b, fold) {
 			return true
 		}
 	}
@@ -1,10 +1,15 @@
 package sheriff
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -324,6 +329,125 @@ func TestMarshal_Versions(t *testing.T) {
 	assert.Equal(t, string(expected), string(actual))
 }
 
+type VersionConstraintModel struct {
+	DefaultMarshal string `json:"default_marshal"`
+	Range          string `json:"range" version:">= 1.2, < 2.0, != 1.5.3"`
+	Precedence     string `json:"precedence" version:">= 3" since:"1" until:"2"`
+}
+
+func TestMarshal_VersionConstraint(t *testing.T) {
+	testModel := VersionConstraintModel{
+		DefaultMarshal: "DefaultMarshal",
+		Range:          "Range",
+		Precedence:     "Precedence",
+	}
+
+	tests := []struct {
+		version  string
+		expected string
+	}{
+		{"1.1.9", `{"default_marshal":"DefaultMarshal"}`},
+		{"1.2.0", `{"default_marshal":"DefaultMarshal","range":"Range"}`},
+		{"1.5.3", `{"default_marshal":"DefaultMarshal"}`},
+		{"1.9.0", `{"default_marshal":"DefaultMarshal","range":"Range"}`},
+		{"2.0.0", `{"default_marshal":"DefaultMarshal"}`},
+		{"3.0.0", `{"default_marshal":"DefaultMarshal","precedence":"Precedence"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.version, func(t *testing.T) {
+			o := &Options{ApiVersion: version.Must(version.NewVersion(test.version))}
+			actualMap, err := Marshal(o, testModel)
+			assert.NoError(t, err)
+
+			actual, err := json.Marshal(actualMap)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(actual))
+		})
+	}
+
+	_, err := Marshal(&Options{ApiVersion: version.Must(version.NewVersion("1.0.0"))}, struct {
+		Invalid string `json:"invalid" version:"x"`
+	}{})
+	assert.EqualError(t, err, "Malformed constraint: x")
+
+	_, err = Marshal(&Options{}, testModel)
+	assert.EqualError(t, err, "sheriff: field Range has version tag but Options.ApiVersion is nil")
+}
+
+func TestMarshal_PrereleaseVersions(t *testing.T) {
+	testModel := struct {
+		Since21    string `json:"since_21" since:"2.1"`
+		Until21    string `json:"until_21" until:"2.1"`
+		Until20    string `json:"until_20" until:"2.0"`
+		Constraint string `json:"constraint" version:">= 2.1"`
+	}{"Since21", "Until21", "Until20", "Constraint"}
+
+	tests := []struct {
+		version          string
+		ignorePrerelease bool
+		expected         string
+	}{
+		{"2.1.0-beta.1", false, `{"until_21":"Until21"}`},
+		{"2.1.0-beta.1", true, `{"constraint":"Constraint","since_21":"Since21","until_21":"Until21"}`},
+		{"2.1.0+build.5", false, `{"constraint":"Constraint","since_21":"Since21","until_21":"Until21"}`},
+		{"2.1.0", false, `{"constraint":"Constraint","since_21":"Since21","until_21":"Until21"}`},
+		{"2.1.1-rc.1", false, `{"since_21":"Since21"}`},
+		{"2.1.1-rc.1", true, `{"constraint":"Constraint","since_21":"Since21"}`},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/ignore=%t", test.version, test.ignorePrerelease), func(t *testing.T) {
+			o := &Options{
+				ApiVersion:       version.Must(version.NewVersion(test.version)),
+				IgnorePrerelease: test.ignorePrerelease,
+			}
+			actualMap, err := Marshal(o, testModel)
+			assert.NoError(t, err)
+
+			actual, err := json.Marshal(actualMap)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(actual))
+		})
+	}
+}
+
+func TestMarshal_ExclusiveUntil(t *testing.T) {
+	testModel := struct {
+		DefaultMarshal string `json:"default_marshal"`
+		Until20        string `json:"until_20" until:"2"`
+		Until21        string `json:"until_21" until:"2.1"`
+	}{
+		DefaultMarshal: "DefaultMarshal",
+		Until20:        "Until20",
+		Until21:        "Until21",
+	}
+
+	tests := []struct {
+		version   string
+		exclusive bool
+		expected  string
+	}{
+		{"1.9.9", true, `{"default_marshal":"DefaultMarshal","until_20":"Until20","until_21":"Until21"}`},
+		{"2.0.0", false, `{"default_marshal":"DefaultMarshal","until_20":"Until20","until_21":"Until21"}`},
+		{"2.0.0", true, `{"default_marshal":"DefaultMarshal","until_21":"Until21"}`},
+		{"2.1.0", false, `{"default_marshal":"DefaultMarshal","until_21":"Until21"}`},
+		{"2.1.0", true, `{"default_marshal":"DefaultMarshal"}`},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s/exclusive=%t", test.version, test.exclusive), func(t *testing.T) {
+			o := &Options{
+				ApiVersion:     version.Must(version.NewVersion(test.version)),
+				ExclusiveUntil: test.exclusive,
+			}
+			actualMap, err := Marshal(o, testModel)
+			assert.NoError(t, err)
+
+			actual, err := json.Marshal(actualMap)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(actual))
+		})
+	}
+}
+
 type IsMarshaller struct {
 	ShouldMarshal string `json:"should_marshal" groups:"test"`
 }
@@ -420,6 +544,37 @@ func TestMarshal_NoJSONTAG(t *testing.T) {
 	assert.Equal(t, string(expected), string(actual))
 }
 
+func TestMarshal_KeyNamingStrategy(t *testing.T) {
+	type namingModel struct {
+		SomeData   string
+		UserID     string
+		HTTPServer string
+		FooÄrger   string
+		Explicit   string `json:"ExplicitName"`
+		OmitEmpty  string `json:",omitempty"`
+	}
+	v := namingModel{SomeData: "a", UserID: "b", HTTPServer: "c", FooÄrger: "e", Explicit: "d"}
+
+	tests := []struct {
+		strategy string
+		expected string
+	}{
+		{"", `{"ExplicitName":"d","FooÄrger":"e","HTTPServer":"c","SomeData":"a","UserID":"b"}`},
+		{KeyNamingCamelCase, `{"ExplicitName":"d","fooÄrger":"e","httpServer":"c","someData":"a","userId":"b"}`},
+		{KeyNamingSnakeCase, `{"ExplicitName":"d","foo_ärger":"e","http_server":"c","some_data":"a","user_id":"b"}`},
+		{KeyNamingKebabCase, `{"ExplicitName":"d","foo-ärger":"e","http-server":"c","some-data":"a","user-id":"b"}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(&Options{KeyNamingStrategy: test.strategy}, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), "strategy %q", test.strategy)
+	}
+}
+
 type UserInfo struct {
 	UserPrivateInfo `groups:"private"`
 	UserPublicInfo  `groups:"public"`
@@ -459,6 +614,38 @@ func TestMarshal_ParentInherit(t *testing.T) {
 
 }
 
+func TestMarshal_DisableEmbeddedGroupInheritance(t *testing.T) {
+	testModel := UserInfo{
+		UserPrivateInfo: UserPrivateInfo{Age: "20"},
+		UserPublicInfo:  UserPublicInfo{ID: "F94", Email: "hello@hello.com"},
+	}
+
+	tests := []struct {
+		disable  bool
+		expected string
+	}{
+		// Age inherits the private group of UserPrivateInfo
+		{false, `{"ID":"F94"}`},
+		// Age has no groups on its own
+		{true, `{"Age":"20","ID":"F94"}`},
+	}
+
+	for _, test := range tests {
+		o := &Options{
+			Groups:                          []string{"public"},
+			IncludeEmptyTag:                 true,
+			DisableEmbeddedGroupInheritance: test.disable,
+		}
+
+		actualMap, err := Marshal(o, testModel)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual))
+	}
+}
+
 type TimeHackTest struct {
 	ATime time.Time `json:"a_time" groups:"test"`
 }
@@ -658,6 +845,61 @@ func TestMarshal_EmbeddedField(t *testing.T) {
 	})
 }
 
+// EmbeddedMapMarshaller is a Marshaller returning a plain map.
+type EmbeddedMapMarshaller struct {
+	ID int
+}
+
+func (m EmbeddedMapMarshaller) Marshal(options *Options) (interface{}, error) {
+	return map[string]interface{}{"id": m.ID}, nil
+}
+
+// EmbeddedScalarMarshaller is a Marshaller returning a scalar.
+type EmbeddedScalarMarshaller struct{}
+
+func (EmbeddedScalarMarshaller) Marshal(options *Options) (interface{}, error) {
+	return "scalar", nil
+}
+
+func TestMarshal_EmbeddedMarshaller(t *testing.T) {
+	type embeddingModel struct {
+		IsMarshaller
+		EmbeddedMapMarshaller
+		EmbeddedScalarMarshaller
+		Bar string `json:"bar"`
+	}
+	type embeddingPtrModel struct {
+		*IsMarshaller
+		Named EmbeddedMapMarshaller `json:"named"`
+		Bar   string                `json:"bar"`
+	}
+
+	tests := []struct {
+		data     interface{}
+		expected string
+	}{
+		// the keys of embedded Marshallers resulting in an object are flattened, others are set under the field name
+		{
+			embeddingModel{IsMarshaller: IsMarshaller{"yes"}, EmbeddedMapMarshaller: EmbeddedMapMarshaller{1}, Bar: "bar"},
+			`{"EmbeddedScalarMarshaller":"scalar","bar":"bar","id":1,"should_marshal":"yes"}`,
+		},
+		// embedded structs with a json name aren't flattened
+		{
+			embeddingPtrModel{IsMarshaller: &IsMarshaller{"yes"}, Named: EmbeddedMapMarshaller{1}, Bar: "bar"},
+			`{"bar":"bar","named":{"id":1},"should_marshal":"yes"}`,
+		},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(&Options{Groups: []string{"test"}, IncludeEmptyTag: true}, test.data)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual))
+	}
+}
+
 type TestMarshal_EmbeddedEmpty struct {
 	Foo string
 }
@@ -776,6 +1018,30 @@ func TestMarshal_InlineStruct(t *testing.T) {
 	assert.Equal(t, string(expected), string(actual))
 }
 
+func TestMarshal_InlineStructGroups(t *testing.T) {
+	type testStruct struct {
+		Info struct {
+			Name   string `json:"name" groups:"user,admin"`
+			Secret string `json:"secret" groups:"admin"`
+		} `json:"info" groups:"user,admin"`
+	}
+	var v testStruct
+	v.Info.Name = "alice"
+	v.Info.Secret = "secret"
+
+	m, err := Marshal(&Options{Groups: []string{"user"}}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"info":{"name":"alice"}}`, string(d))
+
+	m, err = Marshal(&Options{Groups: []string{"admin"}}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"info":{"name":"alice","secret":"secret"}}`, string(d))
+}
+
 type TestInet struct {
 	IPv4 net.IP `json:"ipv4"`
 	IPv6 net.IP `json:"ipv6"`
@@ -825,8 +1091,34 @@ func TestMarshal_EmptyInterface(t *testing.T) {
 	v := EmptyInterfaceStruct{}
 	o := &Options{}
 
-	_, err := Marshal(o, v)
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"data":null}`, string(d))
+}
+
+func TestMarshal_NilInterfaceAsEmptyObject(t *testing.T) {
+	type nilFields struct {
+		Data    interface{}       `json:"data"`
+		Set     interface{}       `json:"set"`
+		Pointer *AModel           `json:"pointer"`
+		Map     map[string]string `json:"map"`
+	}
+	v := nilFields{Set: "value"}
+
+	m, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"data":null,"map":null,"pointer":null,"set":"value"}`, string(d))
+
+	m, err = Marshal(&Options{NilInterfaceAsEmptyObject: true}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
 	assert.NoError(t, err)
+	assert.Equal(t, `{"data":{},"map":null,"pointer":null,"set":"value"}`, string(d))
 }
 
 func TestMarshal_BooleanPtrMap(t *testing.T) {
@@ -849,6 +1141,44 @@ func TestMarshal_BooleanPtrMap(t *testing.T) {
 	assert.Equal(t, string(marshal), string(expect))
 }
 
+func TestMarshal_NilBoolInMapAs(t *testing.T) {
+	tru := true
+
+	toMarshal := map[string]*bool{
+		"example": &tru,
+		"another": nil,
+	}
+
+	marshalMap, err := Marshal(&Options{NilBoolInMapAs: false}, toMarshal)
+	assert.NoError(t, err)
+	marshal, err := json.Marshal(marshalMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"another":false,"example":true}`, string(marshal))
+
+	marshalMap, err = Marshal(&Options{}, toMarshal)
+	assert.NoError(t, err)
+	marshal, err = json.Marshal(marshalMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"another":null,"example":true}`, string(marshal))
+
+	// slices are coerced as well, other nil pointers and struct fields are not
+	v := struct {
+		Flags   []*bool                `json:"flags"`
+		Names   map[string]*string     `json:"names"`
+		Any     map[string]interface{} `json:"any"`
+		Pointer *bool                  `json:"pointer"`
+	}{
+		Flags: []*bool{nil, &tru},
+		Names: map[string]*string{"a": nil},
+		Any:   map[string]interface{}{"a": (*bool)(nil)},
+	}
+	marshalMap, err = Marshal(&Options{NilBoolInMapAs: false}, v)
+	assert.NoError(t, err)
+	marshal, err = json.Marshal(marshalMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"any":{"a":null},"flags":[false,true],"names":{"a":null},"pointer":null}`, string(marshal))
+}
+
 func TestMarshal_NilSlice(t *testing.T) {
 	var stringSlice []string // nil slice
 
@@ -903,7 +1233,110 @@ func TestMarshal_User(t *testing.T) {
 
 	d, err := json.Marshal(m)
 	assert.NoError(t, err)
-	assert.Equal(t, `{"test":"12","testb":"true","testf":"12","tests":"test"}`, string(d))
+	assert.Equal(t, `{"test":"12","testb":"true","testf":"12","tests":"\"test\""}`, string(d))
+
+	expected, err := json.Marshal(j)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(d))
+}
+
+func TestMarshal_StringOption(t *testing.T) {
+	type JsonStringTag struct {
+		F1     float64           `json:"f1,string"`
+		F2     float64           `json:"f2,string"`
+		F3     float64           `json:"f3,string"`
+		F4     float32           `json:"f4,string"`
+		S      string            `json:"s,string"`
+		Ptr    *int              `json:"ptr,string"`
+		NilPtr *int              `json:"nil_ptr,string"`
+		Map    map[string]string `json:"map,string"`
+		Slice  []int             `json:"slice,string"`
+	}
+	i := 3
+	j := JsonStringTag{
+		F1:    12.5,
+		F2:    1e21,
+		F3:    0.000001,
+		F4:    0.1,
+		S:     `a "quoted" <value>`,
+		Ptr:   &i,
+		Map:   map[string]string{"a": "b"},
+		Slice: []int{1, 2},
+	}
+
+	m, err := Marshal(&Options{}, j)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"f1":"12.5","f2":"1e+21","f3":"0.000001","f4":"0.1","map":{"a":"b"},"nil_ptr":null,"ptr":"3","s":"\"a \\\"quoted\\\" \\u003cvalue\\u003e\"","slice":[1,2]}`, string(d))
+
+	expected, err := json.Marshal(j)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(d))
+}
+
+type StringOptionReplaced struct {
+	Secret   string  `json:"secret,string" redact:"true"`
+	Email    string  `json:"email,string" groups:"public,admin" default_groups:"public=hidden"`
+	Price    int     `json:"price,string" via:"FormatPrice"`
+	Amount   float64 `json:"amount,string"`
+	Count    uint    `json:"count,string"`
+	Quantity int64   `json:"quantity,string"`
+}
+
+func (s StringOptionReplaced) FormatPrice(price int, options *Options) (interface{}, error) {
+	return fmt.Sprintf("%d CHF", price), nil
+}
+
+func TestMarshal_StringOptionReplacedValues(t *testing.T) {
+	v := StringOptionReplaced{Secret: "s", Email: "a@example.com", Price: 5, Amount: 1.5, Count: 255, Quantity: 3}
+	o := &Options{
+		Groups:          []string{"public"},
+		IncludeEmptyTag: true,
+		Redact:          true,
+		NumberFormatter: func(kind reflect.Kind, value interface{}) (interface{}, error) {
+			return fmt.Sprintf("%.2f", value), nil
+		},
+		UintFormat: UintFormatHex,
+		TypeMarshallers: map[reflect.Type]func(value interface{}) (interface{}, error){
+			reflect.TypeOf(int64(0)): func(value interface{}) (interface{}, error) {
+				return fmt.Sprintf("%d pcs", value), nil
+			},
+		},
+	}
+
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	// replaced values are emitted as they are instead of being quoted a second time
+	assert.JSONEq(t, `{"secret":"[REDACTED]","email":"hidden","price":"5 CHF","amount":"1.50","count":"ff","quantity":"3 pcs"}`, string(d))
+
+	// the plain values are still quoted
+	m, err = Marshal(&Options{Groups: []string{"admin"}, IncludeEmptyTag: true}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"secret":"\"s\"","email":"\"a@example.com\"","price":"5 CHF","amount":"1.5","count":"255","quantity":"3"}`, string(d))
+}
+
+func TestMarshal_StringOptionUnsupported(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	_, err := Marshal(&Options{}, struct {
+		CreatedAt time.Time `json:"created_at,string"`
+	}{now})
+	assert.EqualError(t, err, "field created_at: marshaller: the string option is not supported for type time.Time")
+
+	_, err = Marshal(&Options{}, struct {
+		UpdatedAt *time.Time `json:"updated_at,string"`
+	}{&now})
+	assert.EqualError(t, err, "field updated_at: marshaller: the string option is not supported for type *time.Time")
+
+	_, err = Marshal(&Options{}, struct {
+		IP net.IP `json:"ip,string"`
+	}{net.ParseIP("127.0.0.1")})
+	assert.EqualError(t, err, "field ip: marshaller: the string option is not supported for type net.IP")
 }
 
 func TestMarshal_CustomFieldFilter(t *testing.T) {
@@ -928,3 +1361,2821 @@ func TestMarshal_CustomFieldFilter(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, `{"test":"teststring"}`, string(d))
 }
+
+func TestMarshal_ValueFieldFilter(t *testing.T) {
+	type testStruct struct {
+		Name    string `json:"name"`
+		Balance int    `json:"balance"`
+	}
+	o := &Options{
+		ValueFieldFilter: func(field reflect.StructField, value reflect.Value) (bool, error) {
+			return field.Name != "Balance" || value.Int() < 0, nil
+		},
+	}
+
+	m, err := Marshal(o, []testStruct{{Name: "alice", Balance: 10}, {Name: "bob", Balance: -5}})
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"name":"alice"},{"balance":-5,"name":"bob"}]`, string(d))
+
+	// ValueFieldFilter takes precedence over FieldFilter
+	o.FieldFilter = func(field reflect.StructField) (bool, error) {
+		return false, nil
+	}
+	m, err = Marshal(o, testStruct{Name: "bob", Balance: -5})
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"balance":-5,"name":"bob"}`, string(d))
+}
+
+type contextKey struct{}
+
+type ContextMarshallerModel struct{}
+
+func (ContextMarshallerModel) Marshal(options *Options) (interface{}, error) {
+	return options.Context().Value(contextKey{}), nil
+}
+
+func TestMarshal_ContextFieldFilter(t *testing.T) {
+	type testStruct struct {
+		TestValue   string                 `json:"test"`
+		SecretValue string                 `json:"secret" permission:"admin"`
+		Role        ContextMarshallerModel `json:"role"`
+	}
+	v := testStruct{
+		TestValue:   "teststring",
+		SecretValue: "asecretvalue",
+	}
+
+	o := &Options{
+		ContextFieldFilter: func(ctx context.Context, field reflect.StructField) (bool, error) {
+			permission := field.Tag.Get("permission")
+			return permission == "" || permission == ctx.Value(contextKey{}), nil
+		},
+	}
+
+	m, err := MarshalWithContext(context.WithValue(context.Background(), contextKey{}, "admin"), o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"role":"admin","secret":"asecretvalue","test":"teststring"}`, string(d))
+
+	m, err = MarshalWithContext(context.WithValue(context.Background(), contextKey{}, "user"), o, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"role":"user","test":"teststring"}`, string(d))
+
+	// Marshal passes context.Background()
+	m, err = Marshal(o, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"role":null,"test":"teststring"}`, string(d))
+	assert.Nil(t, o.ctx)
+}
+
+type OmitEmptyGroupsModel struct {
+	Username string `json:"username" groups:"public,admin"`
+	Bio      string `json:"bio" groups:"public,admin" omitempty_groups:"public"`
+}
+
+func TestMarshal_OmitEmptyGroups(t *testing.T) {
+	v := OmitEmptyGroupsModel{
+		Username: "alice",
+	}
+
+	m, err := Marshal(&Options{Groups: []string{"public"}}, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"username":"alice"}`, string(d))
+
+	m, err = Marshal(&Options{Groups: []string{"admin"}}, v)
+	assert.NoError(t, err)
+
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"bio":"","username":"alice"}`, string(d))
+
+	v.Bio = "Hello"
+	m, err = Marshal(&Options{Groups: []string{"public"}}, v)
+	assert.NoError(t, err)
+
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"bio":"Hello","username":"alice"}`, string(d))
+}
+
+type OmitDefaultsDatabase struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+type OmitDefaultsConfig struct {
+	Name     string                `json:"name"`
+	Debug    bool                  `json:"debug"`
+	Workers  int                   `json:"workers"`
+	Tags     []string              `json:"tags"`
+	Database OmitDefaultsDatabase  `json:"database"`
+	Cache    *OmitDefaultsDatabase `json:"cache"`
+	Metrics  *OmitDefaultsDatabase `json:"metrics"`
+}
+
+func TestMarshal_OmitDefaults(t *testing.T) {
+	v := OmitDefaultsConfig{
+		Name:     "service",
+		Workers:  4,
+		Database: OmitDefaultsDatabase{Host: "localhost"},
+		Metrics:  &OmitDefaultsDatabase{},
+	}
+
+	m, err := Marshal(&Options{OmitDefaults: true}, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"database":{"host":"localhost"},"name":"service","workers":4}`, string(d))
+
+	m, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(d))
+}
+
+type OmitEmptyStructsChild struct {
+	Secret string `json:"secret" groups:"admin"`
+	Note   string `json:"note,omitempty" groups:"api"`
+}
+
+type OmitEmptyStructsModel struct {
+	Name     string                 `json:"name" groups:"api"`
+	Child    OmitEmptyStructsChild  `json:"child,omitempty" groups:"api"`
+	ChildPtr *OmitEmptyStructsChild `json:"child_ptr,omitempty" groups:"api"`
+	Kept     OmitEmptyStructsChild  `json:"kept" groups:"api"`
+}
+
+func TestMarshal_OmitEmptyStructs(t *testing.T) {
+	v := OmitEmptyStructsModel{
+		Name:     "alice",
+		Child:    OmitEmptyStructsChild{Secret: "secret"},
+		ChildPtr: &OmitEmptyStructsChild{Secret: "secret"},
+		Kept:     OmitEmptyStructsChild{Secret: "secret"},
+	}
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		{&Options{Groups: []string{"api"}}, `{"child":{},"child_ptr":{},"kept":{},"name":"alice"}`},
+		// fields without omitempty are kept
+		{&Options{Groups: []string{"api"}, OmitEmptyStructs: true}, `{"kept":{},"name":"alice"}`},
+		{&Options{Groups: []string{"api", "admin"}, OmitEmptyStructs: true}, `{"child":{"secret":"secret"},"child_ptr":{"secret":"secret"},"kept":{"secret":"secret"},"name":"alice"}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(test.options, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), "groups %v", test.options.Groups)
+	}
+}
+
+type OmitEmptyNestedChild struct {
+	Secret string `json:"secret" groups:"admin"`
+	Debug  string `json:"debug" groups:"internal"`
+}
+
+type OmitEmptyNestedModel struct {
+	Name     string                `json:"name" groups:"api"`
+	Child    OmitEmptyNestedChild  `json:"child" groups:"api"`
+	ChildPtr *OmitEmptyNestedChild `json:"child_ptr" groups:"api"`
+	Empty    struct{}              `json:"empty" groups:"api"`
+	Note     struct {
+		Text string `json:"text,omitempty" groups:"api"`
+	} `json:"note" groups:"api"`
+}
+
+func TestMarshal_OmitEmptyNested(t *testing.T) {
+	v := OmitEmptyNestedModel{
+		Name:     "alice",
+		Child:    OmitEmptyNestedChild{Secret: "secret", Debug: "debug"},
+		ChildPtr: &OmitEmptyNestedChild{Secret: "secret", Debug: "debug"},
+	}
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		{&Options{Groups: []string{"api"}}, `{"child":{},"child_ptr":{},"empty":{},"name":"alice","note":{}}`},
+		// objects which are empty without filtering are kept
+		{&Options{Groups: []string{"api"}, OmitEmptyNested: true}, `{"empty":{},"name":"alice","note":{}}`},
+		{&Options{Groups: []string{"api", "admin"}, OmitEmptyNested: true}, `{"child":{"secret":"secret"},"child_ptr":{"secret":"secret"},"empty":{},"name":"alice","note":{}}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(test.options, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), "groups %v", test.options.Groups)
+	}
+}
+
+type NumberFormatterModel struct {
+	Visitors int64             `json:"visitors"`
+	Revenue  float64           `json:"revenue"`
+	Small    uint8             `json:"small"`
+	Name     string            `json:"name"`
+	Counts   map[string]uint32 `json:"counts"`
+}
+
+func groupDigits(s string) string {
+	var b []byte
+	for i := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b = append(b, ',')
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+func TestMarshal_NumberFormatter(t *testing.T) {
+	v := NumberFormatterModel{
+		Visitors: 1234567,
+		Revenue:  1234.5,
+		Small:    12,
+		Name:     "12345",
+		Counts:   map[string]uint32{"a": 1000},
+	}
+
+	var kinds []reflect.Kind
+	o := &Options{
+		NumberFormatter: func(kind reflect.Kind, value interface{}) (interface{}, error) {
+			kinds = append(kinds, kind)
+			if kind == reflect.Float64 {
+				return value.(float64) * 2, nil
+			}
+			return groupDigits(fmt.Sprintf("%d", value)), nil
+		},
+	}
+
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"counts":{"a":"1,000"},"name":"12345","revenue":2469,"small":"12","visitors":"1,234,567"}`, string(d))
+	assert.ElementsMatch(t, []reflect.Kind{reflect.Int64, reflect.Float64, reflect.Uint8, reflect.Uint32}, kinds)
+
+	o.NumberFormatter = func(kind reflect.Kind, value interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("unsupported %s", kind)
+	}
+	_, err = Marshal(o, v)
+	assert.Error(t, err)
+}
+
+type OmitEmptyEmbedded struct {
+	Foo string `json:"foo,omitempty"`
+	Bar int    `json:"bar"`
+}
+
+type OmitEmptyEmbeddedParent struct {
+	OmitEmptyEmbedded `json:",omitempty"`
+	Baz               string `json:"baz"`
+}
+
+type OmitEmptyEmbeddedPtrParent struct {
+	*OmitEmptyEmbedded `json:",omitempty"`
+	Baz                string `json:"baz"`
+}
+
+func TestMarshal_EmbeddedOmitEmpty(t *testing.T) {
+	tests := map[string]interface{}{
+		"zero":              OmitEmptyEmbeddedParent{Baz: "baz"},
+		"populated":         OmitEmptyEmbeddedParent{OmitEmptyEmbedded{"foo", 1}, "baz"},
+		"nil pointer":       OmitEmptyEmbeddedPtrParent{Baz: "baz"},
+		"populated pointer": OmitEmptyEmbeddedPtrParent{&OmitEmptyEmbedded{"foo", 1}, "baz"},
+	}
+
+	for name, v := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := Marshal(&Options{}, v)
+			assert.NoError(t, err)
+
+			actual, err := json.Marshal(m)
+			assert.NoError(t, err)
+
+			expected, err := json.Marshal(v)
+			assert.NoError(t, err)
+
+			assert.JSONEq(t, string(expected), string(actual))
+		})
+	}
+}
+
+type ScalarMarshaller struct {
+	Value string
+}
+
+func (s ScalarMarshaller) Marshal(options *Options) (interface{}, error) {
+	return "scalar:" + s.Value, nil
+}
+
+type ScalarMarshallerParent struct {
+	ScalarMarshaller
+	Named ScalarMarshaller `json:"named"`
+	Bar   string           `json:"bar"`
+}
+
+func TestMarshal_MarshallerScalar(t *testing.T) {
+	v := ScalarMarshallerParent{
+		ScalarMarshaller: ScalarMarshaller{"embedded"},
+		Named:            ScalarMarshaller{"named"},
+		Bar:              "bar",
+	}
+
+	m, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"ScalarMarshaller":"scalar:embedded","bar":"bar","named":"scalar:named"}`, string(d))
+}
+
+type FilteringMarshallerPair struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+type FilteringMarshaller struct {
+	Pair FilteringMarshallerPair
+}
+
+func (f FilteringMarshaller) Marshal(options *Options) (interface{}, error) {
+	o := *options
+	o.FieldFilter = func(field reflect.StructField) (bool, error) {
+		return field.Name != "A", nil
+	}
+	return Marshal(&o, f.Pair)
+}
+
+type FilteringMarshallerParent struct {
+	Nested FilteringMarshaller `json:"n"`
+}
+
+func TestMarshal_MarshallerFieldFilter(t *testing.T) {
+	v := FilteringMarshallerParent{Nested: FilteringMarshaller{FilteringMarshallerPair{A: "a", B: "b"}}}
+
+	m, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"n":{"b":"b"}}`, string(d))
+}
+
+type WideRow struct {
+	Col1 string `json:"col1"`
+	Col2 string `json:"col2"`
+	Col3 string `json:"col3"`
+	Col4 string `json:"col4" groups:"internal"`
+}
+
+func TestMarshal_MaxFieldsPerObject(t *testing.T) {
+	v := WideRow{"a", "b", "c", "d"}
+
+	_, err := Marshal(&Options{MaxFieldsPerObject: 3}, v)
+	assert.ErrorIs(t, err, ErrTooManyFields)
+	assert.EqualError(t, err, "marshaller: too many fields: object has 4 fields, limit is 3")
+
+	_, err = Marshal(&Options{MaxFieldsPerObject: 3}, map[string]WideRow{"row": v})
+	assert.ErrorIs(t, err, ErrTooManyFields)
+
+	_, err = Marshal(&Options{MaxFieldsPerObject: 3}, map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"})
+	assert.ErrorIs(t, err, ErrTooManyFields)
+
+	m, err := Marshal(&Options{MaxFieldsPerObject: 3, Groups: []string{"internal"}, IncludeEmptyTag: false}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"col4":"d"}`, string(d))
+
+	_, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+}
+
+type IndexedItem struct {
+	Name   string `json:"name"`
+	Hidden bool   `json:"-"`
+}
+
+func TestMarshal_SlicesAsIndexedObjects(t *testing.T) {
+	v := struct {
+		Items []IndexedItem `json:"items"`
+		Tags  []string      `json:"tags"`
+	}{
+		Items: []IndexedItem{{"a", false}, {"b", true}, {"c", false}},
+		Tags:  []string{"x", "y"},
+	}
+
+	hideHidden := func(index int, value reflect.Value) (bool, error) {
+		item, ok := value.Interface().(IndexedItem)
+		return !ok || !item.Hidden, nil
+	}
+
+	m, err := Marshal(&Options{SlicesAsIndexedObjects: true}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"items":{"0":{"name":"a"},"1":{"name":"b"},"2":{"name":"c"}},"tags":{"0":"x","1":"y"}}`, string(d))
+
+	m, err = Marshal(&Options{SlicesAsIndexedObjects: true, ElementFilter: hideHidden}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"items":{"0":{"name":"a"},"2":{"name":"c"}},"tags":{"0":"x","1":"y"}}`, string(d))
+
+	m, err = Marshal(&Options{ElementFilter: hideHidden}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"items":[{"name":"a"},{"name":"c"}],"tags":["x","y"]}`, string(d))
+}
+
+type MinGroupsModel struct {
+	Quorum string `json:"quorum" groups:"min2:a,b,c,d"`
+	Single string `json:"single" groups:"min1:a,b"`
+	Plain  string `json:"plain" groups:"a"`
+}
+
+func TestMarshal_MinGroups(t *testing.T) {
+	v := MinGroupsModel{"quorum", "single", "plain"}
+
+	tests := []struct {
+		groups   []string
+		expected string
+	}{
+		{[]string{"a"}, `{"plain":"plain","single":"single"}`},
+		{[]string{"c"}, `{}`},
+		{[]string{"a", "e"}, `{"plain":"plain","single":"single"}`},
+		{[]string{"a", "c"}, `{"plain":"plain","quorum":"quorum","single":"single"}`},
+		{[]string{"b", "c", "d"}, `{"quorum":"quorum","single":"single"}`},
+	}
+
+	for _, test := range tests {
+		m, err := Marshal(&Options{Groups: test.groups}, v)
+		assert.NoError(t, err)
+
+		d, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(d), "groups %v", test.groups)
+	}
+}
+
+// orderedTestStore is a KVStore keeping the insertion order of its keys.
+type orderedTestStore struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedTestStore() *orderedTestStore {
+	return &orderedTestStore{values: map[string]interface{}{}}
+}
+
+func (s *orderedTestStore) Set(k string, v interface{}) {
+	if _, ok := s.values[k]; !ok {
+		s.keys = append(s.keys, k)
+	}
+	s.values[k] = v
+}
+
+func (s *orderedTestStore) Each(f func(k string, v interface{})) {
+	for _, k := range s.keys {
+		f(k, s.values[k])
+	}
+}
+
+type KeyedHeaders map[string]AModel
+
+func (h KeyedHeaders) Keys() []string {
+	return []string{"z", "a", "m", "missing"}
+}
+
+func TestMarshal_MapKeysOrder(t *testing.T) {
+	nested := newOrderedTestStore()
+	nested.Set("second", AModel{true, true})
+	nested.Set("first", 1)
+
+	v := struct {
+		Headers KeyedHeaders `json:"headers"`
+		Store   KVStore      `json:"store"`
+	}{
+		Headers: KeyedHeaders{"a": {true, true}, "m": {true, false}, "z": {false, true}},
+		Store:   nested,
+	}
+
+	o := &Options{
+		Groups: []string{"test"},
+		KVStoreFactory: func() KVStore {
+			return newOrderedTestStore()
+		},
+		IncludeEmptyTag: true,
+	}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+
+	headers := m.(*orderedTestStore).values["headers"].(*orderedTestStore)
+	assert.Equal(t, []string{"z", "a", "m"}, headers.keys)
+	assert.Equal(t, []string{"something"}, headers.values["a"].(*orderedTestStore).keys)
+
+	store := m.(*orderedTestStore).values["store"].(*orderedTestStore)
+	assert.Equal(t, []string{"second", "first"}, store.keys)
+	assert.Equal(t, []string{"something"}, store.values["second"].(*orderedTestStore).keys)
+}
+
+type SheriffExcludeModel struct {
+	Username     string `json:"username" groups:"api"`
+	PasswordHash string `json:"password_hash" groups:"api" sheriff:"-"`
+}
+
+func TestMarshal_SheriffExclude(t *testing.T) {
+	v := SheriffExcludeModel{"alice", "hash"}
+
+	m, err := Marshal(&Options{Groups: []string{"api"}}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"username":"alice"}`, string(d))
+
+	m, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"username":"alice"}`, string(d))
+
+	d, err = json.Marshal(v)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"username":"alice","password_hash":"hash"}`, string(d))
+}
+
+func TestMarshal_DenyGroups(t *testing.T) {
+	testModel := &TestGroupsModel{
+		DefaultMarshal:     "DefaultMarshal",
+		OnlyGroupTest:      "OnlyGroupTest",
+		OnlyGroupTestOther: "OnlyGroupTestOther",
+		GroupTestAndOther:  "GroupTestAndOther",
+		IncludeEmptyTag:    "IncludeEmptyTag",
+	}
+
+	// deny wins over requested groups
+	m, err := Marshal(&Options{Groups: []string{"test"}, DenyGroups: []string{"test-other"}}, testModel)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"only_group_test":"OnlyGroupTest"}`, string(d))
+
+	// without groups everything but the denied groups is marshalled
+	m, err = Marshal(&Options{DenyGroups: []string{"test"}}, testModel)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(map[string]interface{}{
+		"default_marshal":       "DefaultMarshal",
+		"only_group_test_other": "OnlyGroupTestOther",
+		"include_empty_tag":     "IncludeEmptyTag",
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(d))
+}
+
+type RawJSONModel struct {
+	Settings string  `json:"settings" rawjson:"true"`
+	Optional *string `json:"optional" rawjson:"true"`
+	Plain    string  `json:"plain"`
+}
+
+func TestMarshal_RawJSON(t *testing.T) {
+	optional := `[1,2]`
+	v := RawJSONModel{
+		Settings: `{"a":1}`,
+		Optional: &optional,
+		Plain:    `{"a":1}`,
+	}
+
+	m, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"optional":[1,2],"plain":"{\"a\":1}","settings":{"a":1}}`, string(d))
+
+	v.Optional = nil
+	m, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"optional":null,"plain":"{\"a\":1}","settings":{"a":1}}`, string(d))
+
+	v.Settings = `{"a":`
+	_, err = Marshal(&Options{}, v)
+	assert.EqualError(t, err, "field settings: marshaller: invalid raw JSON")
+
+	empty := ""
+	v.Settings = ""
+	v.Optional = &empty
+	m, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"optional":null,"plain":"{\"a\":1}","settings":null}`, string(d))
+
+	m, err = Marshal(&Options{}, struct {
+		Settings string `json:"settings,omitempty" rawjson:"true"`
+	}{})
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{}`, string(d))
+}
+
+type PreviewModel struct {
+	Comments []string `json:"comments" maxitems:"2"`
+	Tags     []string `json:"tags"`
+	IP       net.IP   `json:"ip" maxitems:"1"`
+}
+
+func TestMarshal_MaxItems(t *testing.T) {
+	v := PreviewModel{
+		Comments: []string{"a", "b", "c"},
+		Tags:     []string{"x", "y", "z", "w"},
+		IP:       net.ParseIP("127.0.0.1").To4(),
+	}
+
+	m, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"comments":["a","b"],"ip":"127.0.0.1","tags":["x","y","z","w"]}`, string(d))
+
+	m, err = Marshal(&Options{DefaultMaxItems: 3, MarkTruncated: true}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"comments":["a","b"],"comments_truncated":true,"ip":"127.0.0.1","tags":["x","y","z"],"tags_truncated":true}`, string(d))
+
+	// the limit applies to the filtered elements
+	o := &Options{
+		MarkTruncated: true,
+		ElementFilter: func(index int, value reflect.Value) (bool, error) {
+			return value.String() != "a", nil
+		},
+	}
+	m, err = Marshal(o, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"comments":["b","c"],"ip":"127.0.0.1","tags":["x","y","z","w"]}`, string(d))
+
+	_, err = Marshal(&Options{}, struct {
+		Items []string `json:"items" maxitems:"ten"`
+	}{[]string{"a"}})
+	assert.Error(t, err)
+}
+
+type TruncatedCollisionModel struct {
+	TagsTruncated string   `json:"tags_truncated" groups:"api"`
+	Tags          []string `json:"tags" groups:"api" maxitems:"1"`
+	Items         []string `json:"items" groups:"api" maxitems:"1"`
+}
+
+func TestMarshal_MarkTruncatedKeyChecks(t *testing.T) {
+	v := TruncatedCollisionModel{"field", []string{"a", "b"}, []string{"c", "d"}}
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		// a field with the same key wins over the marker
+		{&Options{MarkTruncated: true, Groups: []string{"api"}}, `{"items":["c"],"items_truncated":true,"tags":["a"],"tags_truncated":"field"}`},
+		{&Options{MarkTruncated: true, Groups: []string{"api"}, ReservedKeys: []string{"items_truncated"}}, `{"_items_truncated":true,"items":["c"],"tags":["a"],"tags_truncated":"field"}`},
+		{&Options{MarkTruncated: true, Groups: []string{"api"}, GroupKeyDeny: map[string][]string{"api": {"items_truncated"}}}, `{"items":["c"],"tags":["a"],"tags_truncated":"field"}`},
+	}
+
+	for _, test := range tests {
+		m, err := Marshal(test.options, v)
+		assert.NoError(t, err)
+		d, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(d))
+	}
+}
+
+type NegatedGroupsModel struct {
+	Public      string `json:"public" groups:"api,!internal"`
+	OnlyNegated string `json:"only_negated" groups:"!internal"`
+	Internal    string `json:"internal" groups:"internal"`
+}
+
+func TestMarshal_NegatedGroups(t *testing.T) {
+	v := NegatedGroupsModel{"public", "only_negated", "internal"}
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		{&Options{Groups: []string{"api"}}, `{"public":"public"}`},
+		{&Options{Groups: []string{"api", "internal"}}, `{"internal":"internal"}`},
+		{&Options{Groups: []string{"internal"}, IncludeEmptyTag: true}, `{"internal":"internal"}`},
+		{&Options{Groups: []string{"api"}, IncludeEmptyTag: true}, `{"only_negated":"only_negated","public":"public"}`},
+	}
+
+	for _, test := range tests {
+		m, err := Marshal(test.options, v)
+		assert.NoError(t, err)
+
+		d, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(d), "groups %v", test.options.Groups)
+	}
+}
+
+func TestMarshal_WildcardGroup(t *testing.T) {
+	type wildcardModel struct {
+		API      string `json:"api" groups:"api"`
+		Admin    string `json:"admin" groups:"admin,internal"`
+		Untagged string `json:"untagged"`
+		Future   string `json:"future" groups:"api" since:"3"`
+	}
+	v := wildcardModel{"api", "admin", "untagged", "future"}
+
+	v2, err := version.NewVersion("2.0.0")
+	assert.NoError(t, err)
+
+	m, err := Marshal(&Options{Groups: []string{"*"}, ApiVersion: v2}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"admin":"admin","api":"api"}`, string(d))
+
+	m, err = Marshal(&Options{Groups: []string{"*"}, ApiVersion: v2, IncludeEmptyTag: true}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"admin":"admin","api":"api","untagged":"untagged"}`, string(d))
+}
+
+func TestMarshal_PointerToSlice(t *testing.T) {
+	type pointerToSlice struct {
+		Tags *[]string `json:"tags"`
+	}
+	empty := []string{}
+	populated := []string{"a", "b"}
+
+	tests := map[string]pointerToSlice{
+		"nil pointer":                {},
+		"pointer to empty slice":     {&empty},
+		"pointer to populated slice": {&populated},
+	}
+
+	for name, v := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := Marshal(&Options{}, v)
+			assert.NoError(t, err)
+
+			actual, err := json.Marshal(m)
+			assert.NoError(t, err)
+
+			expected, err := json.Marshal(v)
+			assert.NoError(t, err)
+
+			assert.Equal(t, string(expected), string(actual))
+		})
+	}
+}
+
+type PaymentNote struct {
+	Text string `json:"text"`
+}
+
+type PaymentOrder struct {
+	ID    string                   `json:"id"`
+	Notes []PaymentNote            `json:"notes"`
+	Meta  map[string][]PaymentNote `json:"meta"`
+}
+
+func TestMarshal_ValueRedactors(t *testing.T) {
+	v := PaymentOrder{
+		ID:    "order-1",
+		Notes: []PaymentNote{{"paid with 4111 1111 1111 1234"}},
+		Meta:  map[string][]PaymentNote{"history": {{"card 5500-0000-0000-0004 declined"}}},
+	}
+
+	o := &Options{
+		ValueRedactors: []ValueRedactor{
+			{Pattern: regexp.MustCompile(`\b(?:\d{4}[ -]?){3}(\d{4})\b`), Replacement: "****-****-****-$1"},
+		},
+	}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"order-1","meta":{"history":[{"text":"card ****-****-****-0004 declined"}]},"notes":[{"text":"paid with ****-****-****-1234"}]}`, string(d))
+}
+
+type RedactedCode string
+
+func (c RedactedCode) String() string {
+	return "code"
+}
+
+func TestMarshal_ValueRedactorsStringer(t *testing.T) {
+	type codeModel struct {
+		A RedactedCode  `json:"a"`
+		B *RedactedCode `json:"b"`
+		C string        `json:"c"`
+		D json.Number   `json:"d"`
+	}
+	code := RedactedCode("1234")
+	v := codeModel{A: "1234", B: &code, C: "1234", D: "1234"}
+
+	o := &Options{ValueRedactors: []ValueRedactor{{Pattern: regexp.MustCompile(`\d`), Replacement: "*"}}}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a":"****","b":"****","c":"****","d":1234}`, string(d))
+}
+
+type RedactedMarshaller struct{}
+
+func (m RedactedMarshaller) Marshal(options *Options) (interface{}, error) {
+	return map[string]interface{}{"s": "1234-5678"}, nil
+}
+
+type RedactedMoney struct {
+	Cents int
+}
+
+func TestMarshal_ValueRedactorsWholeTree(t *testing.T) {
+	type redactedModel struct {
+		Marsh RedactedMarshaller `json:"marsh"`
+		Money RedactedMoney      `json:"money"`
+		Raw   string             `json:"raw" rawjson:"true"`
+		Email string             `json:"email" groups:"public" default_groups:"public=1234-5678"`
+	}
+	v := redactedModel{Raw: `{"card":"1234-5678","n":1}`}
+
+	o := &Options{
+		Groups:          []string{"public"},
+		ValueRedactors:  []ValueRedactor{{Pattern: regexp.MustCompile(`\d{4}-\d{4}`), Replacement: "****"}},
+		IncludeEmptyTag: true,
+		TypeMarshallers: map[reflect.Type]func(value interface{}) (interface{}, error){
+			reflect.TypeOf(RedactedMoney{}): func(value interface{}) (interface{}, error) {
+				return "1234-5678", nil
+			},
+		},
+	}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"email":"****","marsh":{"s":"****"},"money":"****","raw":{"card":"****","n":1}}`, string(d))
+}
+
+func TestMarshal_MatchAllGroups(t *testing.T) {
+	type matchAllModel struct {
+		Both     string `json:"both" groups:"beta,internal"`
+		Beta     string `json:"beta" groups:"beta"`
+		All      string `json:"all" groups:"beta,internal,admin"`
+		Untagged string `json:"untagged"`
+	}
+	v := matchAllModel{"both", "beta", "all", "untagged"}
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		{&Options{Groups: []string{"beta", "internal"}}, `{"all":"all","beta":"beta","both":"both"}`},
+		{&Options{Groups: []string{"beta", "internal"}, MatchAllGroups: true}, `{"all":"all","both":"both"}`},
+		{&Options{Groups: []string{"beta", "internal", "admin"}, MatchAllGroups: true}, `{"all":"all"}`},
+		{&Options{Groups: []string{"beta", "internal"}, MatchAllGroups: true, IncludeEmptyTag: true}, `{"all":"all","both":"both","untagged":"untagged"}`},
+	}
+
+	for _, test := range tests {
+		m, err := Marshal(test.options, v)
+		assert.NoError(t, err)
+
+		d, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(d), "groups %v", test.options.Groups)
+	}
+}
+
+func TestMarshal_CaseInsensitiveGroups(t *testing.T) {
+	type caseModel struct {
+		Name   string `json:"name" groups:"api" rename:"api:username"`
+		Email  string `json:"email" groups:"admin"`
+		Hidden string `json:"hidden" groups:"api,!Internal"`
+	}
+	v := caseModel{"alice", "alice@example.com", "hidden"}
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		{&Options{Groups: []string{"API"}}, `{}`},
+		{&Options{Groups: []string{"API"}, CaseInsensitiveGroups: true}, `{"hidden":"hidden","username":"alice"}`},
+		{&Options{Groups: []string{"API", "internal"}, CaseInsensitiveGroups: true}, `{"username":"alice"}`},
+	}
+
+	for _, test := range tests {
+		m, err := Marshal(test.options, v)
+		assert.NoError(t, err)
+
+		d, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(d), "groups %v", test.options.Groups)
+	}
+}
+
+func TestMarshal_CaseInsensitiveGroupMaps(t *testing.T) {
+	type caseModel struct {
+		Name         string `json:"name" groups:"public"`
+		NameInternal string `json:"name_internal" groups:"public"`
+		Email        string `json:"email" groups:"staff"`
+	}
+	v := caseModel{"alice", "internal", "alice@example.com"}
+
+	tests := []struct {
+		options  *Options
+		expected string
+	}{
+		{&Options{Groups: []string{"PUBLIC"}, GroupKeyDeny: map[string][]string{"public": {"*_internal"}}}, `{}`},
+		{&Options{Groups: []string{"PUBLIC"}, GroupKeyDeny: map[string][]string{"public": {"*_internal"}}, CaseInsensitiveGroups: true}, `{"name":"alice"}`},
+		{&Options{Groups: []string{"ADMIN"}, GroupAliases: map[string][]string{"admin": {"staff"}}}, `{}`},
+		{&Options{Groups: []string{"ADMIN"}, GroupAliases: map[string][]string{"admin": {"staff"}}, CaseInsensitiveGroups: true}, `{"email":"alice@example.com"}`},
+	}
+
+	for _, test := range tests {
+		m, err := Marshal(test.options, v)
+		assert.NoError(t, err)
+
+		d, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(d), "options %+v", test.options)
+	}
+}
+
+func TestMarshal_FallbackGroups(t *testing.T) {
+	type fallbackModel struct {
+		ID      string   `json:"id" groups:"minimal,api"`
+		Name    string   `json:"name" groups:"api"`
+		Details []AModel `json:"details" groups:"detail"`
+	}
+	v := fallbackModel{ID: "1", Name: "name", Details: []AModel{{true, true}}}
+
+	m, err := Marshal(&Options{Groups: []string{"unknown"}, FallbackGroups: []string{"minimal"}}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"1"}`, string(d))
+
+	m, err = Marshal(&Options{Groups: []string{"api"}, FallbackGroups: []string{"minimal"}}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"1","name":"name"}`, string(d))
+
+	// nested objects don't trigger the fallback
+	m, err = Marshal(&Options{Groups: []string{"detail"}, FallbackGroups: []string{"minimal"}}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"details":[{}]}`, string(d))
+
+	// the struct is marshalled once more for the fallback
+	var types []reflect.Type
+	o := &Options{
+		Groups:         []string{"unknown"},
+		FallbackGroups: []string{"minimal"},
+		OnType: func(t reflect.Type) {
+			types = append(types, t)
+		},
+	}
+	m, err = Marshal(o, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"1"}`, string(d))
+	assert.Equal(t, []reflect.Type{reflect.TypeOf(v), reflect.TypeOf(v)}, types)
+}
+
+func TestMarshal_Concurrent(t *testing.T) {
+	o := &Options{Groups: []string{"public"}}
+	models := []interface{}{
+		UserInfo{
+			UserPrivateInfo: UserPrivateInfo{Age: "20"},
+			UserPublicInfo:  UserPublicInfo{ID: "F94", Email: "hello@hello.com"},
+		},
+		TestMarshal_EmbeddedParent{
+			&TestMarshal_Embedded{"Hello"},
+			&TestMarshal_NamedEmbedded{"Big"},
+			&TestMarshal_EmbeddedCustom{10, true},
+			&TestMarshal_EmbeddedCustomPtr{20, true},
+			"World",
+		},
+	}
+	expected := []string{
+		`{"ID":"F94"}`,
+		`{"embedded":{},"value":10,"value_ptr":20}`,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for j := range models {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+
+				m, err := Marshal(o, models[j])
+				assert.NoError(t, err)
+
+				d, err := json.Marshal(m)
+				assert.NoError(t, err)
+				assert.Equal(t, expected[j], string(d))
+			}(j)
+		}
+	}
+	wg.Wait()
+
+	assert.Nil(t, o.FieldFilter)
+	assert.Nil(t, o.KVStoreFactory)
+}
+
+type Registry[T any] map[string]T
+
+type List[T any] []T
+
+func TestMarshal_GenericContainers(t *testing.T) {
+	v := struct {
+		Models  Registry[AModel]    `json:"models"`
+		Names   Registry[string]    `json:"names"`
+		Entries List[AModel]        `json:"entries"`
+		Nested  Registry[List[int]] `json:"nested"`
+	}{
+		Models:  Registry[AModel]{"first": {true, true}},
+		Names:   Registry[string]{"a": "b"},
+		Entries: List[AModel]{{true, false}},
+		Nested:  Registry[List[int]]{"n": {1, 2}},
+	}
+
+	m, err := Marshal(&Options{Groups: []string{"test"}, IncludeEmptyTag: true}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"entries":[{"something":true}],"models":{"first":{"something":true}},"names":{"a":"b"},"nested":{"n":[1,2]}}`, string(d))
+}
+
+func TestMarshal_AssertOnlyKeys(t *testing.T) {
+	type accountModel struct {
+		ID           string `json:"id" groups:"api"`
+		Name         string `json:"name" groups:"api"`
+		PasswordHash string `json:"password_hash"`
+		Token        string `json:"token"`
+	}
+	v := accountModel{"1", "name", "hash", "token"}
+
+	o := &Options{Groups: []string{"api"}, AssertOnlyKeys: []string{"id", "name"}}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"1","name":"name"}`, string(d))
+
+	// the untagged sensitive fields leak because of IncludeEmptyTag
+	o.IncludeEmptyTag = true
+	_, err = Marshal(o, v)
+	assert.ErrorIs(t, err, ErrUnexpectedKeys)
+	assert.EqualError(t, err, "marshaller: unexpected keys in output: password_hash, token")
+}
+
+func TestMarshal_GroupKeyDeny(t *testing.T) {
+	type projectModel struct {
+		Name       string `json:"name" groups:"public,admin"`
+		CostCenter string `json:"cost_internal" groups:"public,admin"`
+		Nested     struct {
+			Notes string `json:"notes_internal" groups:"public,admin"`
+			Title string `json:"title" groups:"public,admin"`
+		} `json:"nested" groups:"public,admin"`
+	}
+	v := projectModel{Name: "name", CostCenter: "cc"}
+	v.Nested.Notes = "notes"
+	v.Nested.Title = "title"
+
+	deny := map[string][]string{"public": {"*_internal"}}
+
+	m, err := Marshal(&Options{Groups: []string{"public"}, GroupKeyDeny: deny}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"name":"name","nested":{"title":"title"}}`, string(d))
+
+	m, err = Marshal(&Options{Groups: []string{"admin"}, GroupKeyDeny: deny}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"cost_internal":"cc","name":"name","nested":{"notes_internal":"notes","title":"title"}}`, string(d))
+}
+
+func TestMarshal_GroupKeyDenyMaps(t *testing.T) {
+	type denyModel struct {
+		EmbeddedMapMarshaller
+		Labels map[string]string `json:"labels" groups:"public"`
+		Store  KVStore           `json:"store" groups:"public"`
+	}
+	v := denyModel{
+		EmbeddedMapMarshaller: EmbeddedMapMarshaller{ID: 1},
+		Labels:                map[string]string{"a_internal": "leak", "team": "core"},
+		Store:                 kvStore{"b_internal": "leak", "env": "prod"},
+	}
+	deny := map[string][]string{"public": {"*_internal", "id"}}
+
+	for _, o := range []*Options{
+		{Groups: []string{"public"}, GroupKeyDeny: deny},
+		{Groups: []string{"public"}, GroupKeyDeny: deny, KVStoreFactory: NewOrderedKVStore},
+	} {
+		m, err := Marshal(o, v)
+		assert.NoError(t, err)
+		d, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"labels":{"team":"core"},"store":{"env":"prod"}}`, string(d))
+	}
+
+	m, err := Marshal(&Options{Groups: []string{"public"}, GroupKeyDeny: deny, MapsAsEntries: true}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"labels":[{"key":"team","value":"core"}],"store":{"env":"prod"}}`, string(d))
+}
+
+type OrderedEmbedded struct {
+	Middle string `json:"middle" groups:"api"`
+}
+
+type OrderedModel struct {
+	Zeta  string `json:"zeta" groups:"api"`
+	Alpha int    `json:"alpha" groups:"api"`
+	OrderedEmbedded
+	Nested  AModel            `json:"nested" groups:"api"`
+	Labels  map[string]string `json:"labels" groups:"api"`
+	Private string            `json:"private" groups:"private"`
+	Beta    bool              `json:"beta" groups:"api"`
+}
+
+func TestMarshal_OrderedKVStore(t *testing.T) {
+	v := OrderedModel{
+		Zeta:            "z",
+		Alpha:           1,
+		OrderedEmbedded: OrderedEmbedded{Middle: "m"},
+		Nested:          AModel{true, true},
+		Labels:          map[string]string{"y": "1", "b": "2", "k": "3", "a": "4"},
+		Private:         "secret",
+		Beta:            true,
+	}
+	o := &Options{
+		Groups:         []string{"api", "test"},
+		KVStoreFactory: NewOrderedKVStore,
+	}
+
+	expected := `{"zeta":"z","alpha":1,"middle":"m","nested":{"something":true},"labels":{"a":"4","b":"2","k":"3","y":"1"},"beta":true}`
+	for i := 0; i < 20; i++ {
+		actualMap, err := Marshal(o, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(actual))
+	}
+}
+
+func TestMarshal_OrderedKVStoreReplacesKey(t *testing.T) {
+	s := NewOrderedKVStore()
+	s.Set("b", 1)
+	s.Set("a", 2)
+	s.Set("b", 3)
+
+	actual, err := json.Marshal(s)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"b":3,"a":2}`, string(actual))
+	assert.Equal(t, 2, kvStoreLen(s))
+}
+
+func TestMarshal_OrderedKVStoreValue(t *testing.T) {
+	type child struct {
+		Pub    string `json:"pub" groups:"public"`
+		Secret string `json:"secret" groups:"admin"`
+	}
+	type parent struct {
+		Ordered KVStore `json:"ordered" groups:"public"`
+		Plain   KVStore `json:"plain" groups:"public"`
+	}
+	ordered := NewOrderedKVStore()
+	ordered.Set("c", child{Pub: "p", Secret: "s"})
+	v := parent{Ordered: ordered, Plain: kvStore{"c": child{Pub: "p", Secret: "s"}}}
+
+	actualMap, err := Marshal(&Options{Groups: []string{"public"}}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	// the values of both stores are filtered, even though the ordered store implements json.Marshaler
+	assert.Equal(t, `{"ordered":{"c":{"pub":"p"}},"plain":{"c":{"pub":"p"}}}`, string(actual))
+}
+
+type UintFormatModel struct {
+	Uint   uint    `json:"uint"`
+	Uint8  uint8   `json:"uint8"`
+	Uint16 uint16  `json:"uint16"`
+	Uint32 uint32  `json:"uint32"`
+	Uint64 uint64  `json:"uint64"`
+	Int    int     `json:"int"`
+	Int8   int8    `json:"int8"`
+	Bytes  []byte  `json:"bytes"`
+	Uints  []uint8 `json:"uints"`
+	Ptr    *uint16 `json:"ptr"`
+}
+
+func TestMarshal_UintFormat(t *testing.T) {
+	ptr := uint16(4096)
+	v := UintFormatModel{
+		Uint:   255,
+		Uint8:  255,
+		Uint16: 65535,
+		Uint32: 3735928559,
+		Uint64: 18446744073709551615,
+		Int:    -255,
+		Int8:   127,
+		Bytes:  []byte{0xff, 0x00},
+		Uints:  []uint8{0x01},
+		Ptr:    &ptr,
+	}
+
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format:   "",
+			expected: `{"bytes":"/wA=","int":-255,"int8":127,"ptr":4096,"uint":255,"uint16":65535,"uint32":3735928559,"uint64":18446744073709551615,"uint8":255,"uints":"AQ=="}`,
+		},
+		{
+			format:   UintFormatDec,
+			expected: `{"bytes":"/wA=","int":-255,"int8":127,"ptr":4096,"uint":255,"uint16":65535,"uint32":3735928559,"uint64":18446744073709551615,"uint8":255,"uints":"AQ=="}`,
+		},
+		{
+			format:   UintFormatHex,
+			expected: `{"bytes":"/wA=","int":-255,"int8":127,"ptr":"1000","uint":"ff","uint16":"ffff","uint32":"deadbeef","uint64":"ffffffffffffffff","uint8":"ff","uints":"AQ=="}`,
+		},
+		{
+			format:   UintFormatHexPrefixed,
+			expected: `{"bytes":"/wA=","int":-255,"int8":127,"ptr":"0x1000","uint":"0xff","uint16":"0xffff","uint32":"0xdeadbeef","uint64":"0xffffffffffffffff","uint8":"0xff","uints":"AQ=="}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			actualMap, err := Marshal(&Options{UintFormat: test.format}, v)
+			assert.NoError(t, err)
+
+			actual, err := json.Marshal(actualMap)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(actual))
+		})
+	}
+}
+
+func TestMarshal_UintFormatSliceElements(t *testing.T) {
+	v := struct {
+		Values []uint32          `json:"values"`
+		Map    map[string]uint64 `json:"map"`
+	}{
+		Values: []uint32{10, 11},
+		Map:    map[string]uint64{"a": 16},
+	}
+
+	actualMap, err := Marshal(&Options{UintFormat: UintFormatHexPrefixed}, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"map":{"a":"0x10"},"values":["0xa","0xb"]}`, string(actual))
+}
+
+func TestMarshal_UintFormatUnknown(t *testing.T) {
+	_, err := Marshal(&Options{UintFormat: "octal"}, UintFormatModel{})
+	assert.EqualError(t, err, `field uint: marshaller: unknown UintFormat "octal"`)
+}
+
+func TestMarshal_EmitVersionField(t *testing.T) {
+	v, err := version.NewVersion("2.1.0")
+	assert.NoError(t, err)
+
+	o := &Options{
+		Groups:           []string{"test"},
+		ApiVersion:       v,
+		EmitVersionField: "api_version",
+	}
+
+	actualMap, err := Marshal(o, TestGroupsModel{DefaultMarshal: "default", OnlyGroupTest: "test"})
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"api_version":"2.1.0","group_test_and_other":"","only_group_test":"test"}`, string(actual))
+
+	// only the top-level object gets the version field
+	actualMap, err = Marshal(o, struct {
+		Nested AModel `json:"nested" groups:"test"`
+	}{AModel{true, true}})
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"api_version":"2.1.0","nested":{"something":true}}`, string(actual))
+}
+
+func TestMarshal_EmitVersionFieldSkipped(t *testing.T) {
+	v, err := version.NewVersion("2.1.0")
+	assert.NoError(t, err)
+
+	// no ApiVersion
+	actualMap, err := Marshal(&Options{EmitVersionField: "api_version"}, AModel{true, true})
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"something":true,"something_else":true}`, string(actual))
+
+	o := &Options{ApiVersion: v, EmitVersionField: "api_version"}
+
+	// slice top level
+	actualMap, err = Marshal(o, []AModel{{true, true}})
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"something":true,"something_else":true}]`, string(actual))
+
+	// scalar top level
+	actualMap, err = Marshal(o, "scalar")
+	assert.NoError(t, err)
+	assert.Equal(t, "scalar", actualMap)
+}
+
+func TestMarshal_EmptyMapMatchesJSON(t *testing.T) {
+	v := struct {
+		Empty   map[string]string `json:"empty"`
+		Nil     map[string]string `json:"nil"`
+		Structs map[string]AModel `json:"structs"`
+	}{
+		Empty:   map[string]string{},
+		Structs: map[string]AModel{},
+	}
+
+	actualMap, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, kvStore{}, actualMap.(kvStore)["empty"])
+	assert.Nil(t, actualMap.(kvStore)["nil"])
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+
+	assert.Equal(t, string(expected), string(actual))
+	assert.Equal(t, `{"empty":{},"nil":null,"structs":{}}`, string(actual))
+}
+
+func TestMarshal_OmitEmptySliceAndMap(t *testing.T) {
+	v := struct {
+		Map      map[string]string  `json:"map,omitempty"`
+		Slice    []string           `json:"slice,omitempty"`
+		Array    [0]string          `json:"array,omitempty"`
+		MapPtr   *map[string]string `json:"map_ptr,omitempty"`
+		Filled   []string           `json:"filled,omitempty"`
+		EmptyMap map[string]string  `json:"empty_map"`
+	}{
+		Map:      map[string]string{},
+		Slice:    []string{},
+		MapPtr:   &map[string]string{},
+		Filled:   []string{"a"},
+		EmptyMap: map[string]string{},
+	}
+
+	actualMap, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+
+	assert.JSONEq(t, string(expected), string(actual))
+	// omitempty removes the key of an empty map, without it the map results in {}
+	assert.Equal(t, `{"empty_map":{},"filled":["a"],"map_ptr":{}}`, string(actual))
+}
+
+type OnTypeChild struct {
+	Name string `json:"name"`
+}
+
+type OnTypeParent struct {
+	Children []OnTypeChild          `json:"children"`
+	ByName   map[string]OnTypeChild `json:"by_name"`
+	Ptr      *AModel                `json:"ptr"`
+	Nil      *IsMarshaller          `json:"nil"`
+}
+
+func TestMarshal_OnType(t *testing.T) {
+	v := OnTypeParent{
+		Children: []OnTypeChild{{"a"}, {"b"}},
+		ByName:   map[string]OnTypeChild{"c": {"c"}},
+		Ptr:      &AModel{true, true},
+	}
+
+	var seen []reflect.Type
+	o := &Options{
+		OnType: func(t reflect.Type) {
+			seen = append(seen, t)
+		},
+	}
+
+	withHook, err := Marshal(o, v)
+	assert.NoError(t, err)
+	assert.Equal(t, []reflect.Type{
+		reflect.TypeOf(OnTypeParent{}),
+		reflect.TypeOf(OnTypeChild{}),
+		reflect.TypeOf(AModel{}),
+	}, seen)
+
+	withoutHook, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, withoutHook, withHook)
+
+	// every call reports its types again
+	seen = nil
+	_, err = Marshal(o, []OnTypeChild{{"d"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []reflect.Type{reflect.TypeOf(OnTypeChild{})}, seen)
+}
+
+type MapKeyEnum int
+
+func (e MapKeyEnum) String() string {
+	return [...]string{"zero", "one"}[e]
+}
+
+type MapKeyText struct {
+	A, B string
+}
+
+func (k MapKeyText) MarshalText() ([]byte, error) {
+	return []byte(k.A + "-" + k.B), nil
+}
+
+type MapKeyStringer struct {
+	ID int
+}
+
+func (k MapKeyStringer) String() string {
+	return fmt.Sprintf("id-%d", k.ID)
+}
+
+func TestMarshal_NonStringMapKeys(t *testing.T) {
+	v := struct {
+		Ints     map[int]string            `json:"ints"`
+		Uints    map[uint8]AModel          `json:"uints"`
+		Enums    map[MapKeyEnum]string     `json:"enums"`
+		Text     map[MapKeyText]int        `json:"text"`
+		Stringer map[MapKeyStringer]string `json:"stringer"`
+	}{
+		Ints:     map[int]string{-1: "minus one", 10: "ten", 2: "two"},
+		Uints:    map[uint8]AModel{255: {true, false}},
+		Enums:    map[MapKeyEnum]string{0: "a", 1: "b"},
+		Text:     map[MapKeyText]int{{"x", "y"}: 1},
+		Stringer: map[MapKeyStringer]string{{7}: "seven"},
+	}
+
+	actualMap, err := Marshal(&Options{Groups: []string{"test"}, IncludeEmptyTag: true}, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expected := `{"enums":{"0":"a","1":"b"},"ints":{"-1":"minus one","10":"ten","2":"two"},"stringer":{"id-7":"seven"},"text":{"x-y":1},"uints":{"255":{"something":true}}}`
+	assert.Equal(t, expected, string(actual))
+}
+
+func TestMarshal_NonStringMapKeysOrdered(t *testing.T) {
+	v := map[int]string{10: "ten", 2: "two", -1: "minus one"}
+
+	actualMap, err := Marshal(&Options{KVStoreFactory: NewOrderedKVStore}, v)
+	assert.NoError(t, err)
+
+	// sorted by the string form of the keys, like encoding/json does
+	assert.Equal(t, []string{"-1", "10", "2"}, actualMap.(*orderedKVStore).Keys())
+}
+
+func TestMarshal_UnsupportedMapKeys(t *testing.T) {
+	_, err := Marshal(&Options{}, map[AModel]string{{true, true}: "a"})
+	assert.EqualError(t, err, "marshaller: unsupported map key type sheriff.AModel")
+
+	_, err = Marshal(&Options{}, map[float64]string{1.5: "a"})
+	assert.EqualError(t, err, "marshaller: unsupported map key type float64")
+
+	_, err = Marshal(&Options{}, map[bool]string{true: "a"})
+	assert.EqualError(t, err, "marshaller: unsupported map key type bool")
+}
+
+type CompactLeaf struct {
+	Name  string            `json:"name"`
+	Tags  []string          `json:"tags"`
+	Attrs map[string]string `json:"attrs"`
+	Ptr   *AModel           `json:"ptr"`
+}
+
+type CompactModel struct {
+	Title   string                 `json:"title"`
+	Empty   string                 `json:"empty"`
+	Count   int                    `json:"count"`
+	Enabled bool                   `json:"enabled"`
+	Leaf    CompactLeaf            `json:"leaf"`
+	Leaves  []CompactLeaf          `json:"leaves"`
+	ByName  map[string]CompactLeaf `json:"by_name"`
+	Nothing interface{}            `json:"nothing"`
+}
+
+func TestMarshal_Compact(t *testing.T) {
+	v := CompactModel{
+		Title: "title",
+		Leaf:  CompactLeaf{Tags: []string{}, Attrs: map[string]string{}},
+		Leaves: []CompactLeaf{
+			{},
+			{Name: "second", Tags: []string{"", "a"}},
+			{Attrs: map[string]string{"k": ""}},
+		},
+		ByName: map[string]CompactLeaf{
+			"empty": {},
+			"full":  {Attrs: map[string]string{"k": "v"}, Ptr: &AModel{true, true}},
+		},
+	}
+
+	actualMap, err := Marshal(&Options{Compact: true}, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expected := `{"by_name":{"full":{"attrs":{"k":"v"},"ptr":{"something":true,"something_else":true}}},"count":0,"enabled":false,"leaves":[{"name":"second","tags":["a"]}],"title":"title"}`
+	assert.Equal(t, expected, string(actual))
+
+	// the top-level value itself is kept
+	actualMap, err = Marshal(&Options{Compact: true}, CompactLeaf{})
+	assert.NoError(t, err)
+	assert.Equal(t, kvStore{}, actualMap)
+
+	actualMap, err = Marshal(&Options{Compact: true}, []CompactLeaf{{}, {Name: "a"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{kvStore{"name": "a"}}, actualMap)
+}
+
+func TestMarshal_CompactDisabled(t *testing.T) {
+	actualMap, err := Marshal(&Options{}, CompactLeaf{})
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"attrs":null,"name":"","ptr":null,"tags":null}`, string(actual))
+}
+
+func TestMarshal_SinceWithoutApiVersion(t *testing.T) {
+	v := struct {
+		Name  string `json:"name"`
+		Added string `json:"added" since:"2"`
+	}{"name", "added"}
+
+	_, err := Marshal(&Options{}, v)
+	assert.EqualError(t, err, "sheriff: field Added has since/until tag but Options.ApiVersion is nil")
+
+	_, err = Marshal(&Options{}, TestVersionsModel{})
+	assert.EqualError(t, err, "sheriff: field Until20 has since/until tag but Options.ApiVersion is nil")
+}
+
+type CycleNode struct {
+	Name     string                `json:"name"`
+	Next     *CycleNode            `json:"next"`
+	Children []*CycleNode          `json:"children"`
+	ByName   map[string]*CycleNode `json:"by_name"`
+}
+
+func TestMarshal_Cycle(t *testing.T) {
+	self := &CycleNode{Name: "self"}
+	self.Next = self
+
+	a := &CycleNode{Name: "a"}
+	b := &CycleNode{Name: "b", Next: a}
+	a.Next = b
+
+	throughSlice := &CycleNode{Name: "slice"}
+	throughSlice.Children = []*CycleNode{{Name: "child", Next: throughSlice}}
+
+	throughMap := &CycleNode{Name: "map", ByName: map[string]*CycleNode{}}
+	throughMap.ByName["me"] = throughMap
+
+	tests := []struct {
+		name string
+		node *CycleNode
+		path string
+	}{
+		{"self", self, "next"},
+		{"indirect", a, "next.next"},
+		{"slice", throughSlice, "children[0].next"},
+		{"map", throughMap, "by_name.me"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Marshal(&Options{}, test.node)
+			assert.EqualError(t, err, "field "+test.path+": marshaller: cyclic reference detected at type sheriff.CycleNode")
+
+			var cycleErr MarshalCycleError
+			assert.True(t, errors.As(err, &cycleErr))
+		})
+	}
+}
+
+type CycleNamer interface {
+	GetName() string
+}
+
+type CycleEmbeddedInterface struct {
+	CycleNamer
+	Name string `json:"name"`
+}
+
+func (c *CycleEmbeddedInterface) GetName() string {
+	return c.Name
+}
+
+func TestMarshal_CycleEmbeddedInterface(t *testing.T) {
+	self := &CycleEmbeddedInterface{Name: "self"}
+	self.CycleNamer = self
+
+	a := &CycleEmbeddedInterface{Name: "a"}
+	b := &CycleEmbeddedInterface{Name: "b", CycleNamer: a}
+	a.CycleNamer = b
+
+	for _, v := range []interface{}{self, *self, a} {
+		_, err := Marshal(&Options{}, v)
+		var cycleErr MarshalCycleError
+		assert.True(t, errors.As(err, &cycleErr), "%v", err)
+		assert.ErrorContains(t, err, "cyclic reference detected at type sheriff.CycleEmbeddedInterface")
+	}
+
+	// without a cycle the embedded interface is marshalled under its type name like encoding/json does
+	v := &CycleEmbeddedInterface{Name: "outer", CycleNamer: &CycleEmbeddedInterface{Name: "inner"}}
+	actualMap, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+func TestMarshal_CycleMapValues(t *testing.T) {
+	m := map[string]interface{}{}
+	m["m"] = m
+
+	_, err := Marshal(&Options{}, m)
+	assert.EqualError(t, err, "field m: marshaller: cyclic reference detected at type map[string]interface {}")
+}
+
+func TestMarshal_SharedPointerIsNoCycle(t *testing.T) {
+	shared := &CycleNode{Name: "shared"}
+	v := &CycleNode{
+		Name:     "root",
+		Next:     shared,
+		Children: []*CycleNode{shared, shared},
+	}
+
+	actualMap, err := Marshal(&Options{KVStoreFactory: NewOrderedKVStore}, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+type ViaModel struct {
+	Currency string `json:"currency"`
+	Price    int    `json:"price" via:"FormatPrice"`
+	Discount *int   `json:"discount" via:"FormatDiscount"`
+}
+
+func (m ViaModel) FormatPrice(cents int, options *Options) (interface{}, error) {
+	return fmt.Sprintf("%d.%02d %s", cents/100, cents%100, m.Currency), nil
+}
+
+func (m *ViaModel) FormatDiscount(percent *int, options *Options) (interface{}, error) {
+	if percent == nil {
+		return "none", nil
+	}
+	if *percent > 100 {
+		return nil, errors.New("discount too high")
+	}
+	return fmt.Sprintf("%d%%", *percent), nil
+}
+
+func TestMarshal_Via(t *testing.T) {
+	discount := 15
+	actualMap, err := Marshal(&Options{}, ViaModel{Currency: "CHF", Price: 1250, Discount: &discount})
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"currency":"CHF","discount":"15%","price":"12.50 CHF"}`, string(actual))
+
+	actualMap, err = Marshal(&Options{}, []ViaModel{{Currency: "EUR", Price: 99}})
+	assert.NoError(t, err)
+
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"currency":"EUR","discount":"none","price":"0.99 EUR"}]`, string(actual))
+}
+
+func TestMarshal_ViaError(t *testing.T) {
+	discount := 150
+	_, err := Marshal(&Options{}, &ViaModel{Discount: &discount})
+	assert.EqualError(t, err, "field discount: discount too high")
+}
+
+type ViaSummary struct {
+	Public string `json:"public" groups:"api"`
+	Hidden string `json:"hidden" groups:"admin"`
+}
+
+type ViaStructModel struct {
+	Summary string `json:"s" groups:"api" via:"Expand"`
+}
+
+func (m ViaStructModel) Expand(summary string, options *Options) (interface{}, error) {
+	return ViaSummary{Public: summary, Hidden: "h"}, nil
+}
+
+func TestMarshal_ViaFiltersResult(t *testing.T) {
+	actualMap, err := Marshal(&Options{Groups: []string{"api"}}, ViaStructModel{Summary: "p"})
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"s":{"public":"p"}}`, string(actual))
+}
+
+type ViaMissingModel struct {
+	Price int `json:"price" via:"Missing"`
+}
+
+type ViaSignatureModel struct {
+	Price int `json:"price" via:"FormatPrice"`
+}
+
+func (m ViaSignatureModel) FormatPrice(cents string) string {
+	return cents
+}
+
+func TestMarshal_ViaInvalid(t *testing.T) {
+	_, err := Marshal(&Options{}, ViaMissingModel{})
+	assert.EqualError(t, err, "field price: marshaller: via method Missing not found on sheriff.ViaMissingModel")
+
+	_, err = Marshal(&Options{}, ViaSignatureModel{})
+	assert.EqualError(t, err, "field price: marshaller: via method sheriff.ViaSignatureModel.FormatPrice has signature func(string) string, expected func(int, *sheriff.Options) (interface{}, error)")
+}
+
+type MapKeyCollision struct {
+	ID, Version int
+}
+
+func (k MapKeyCollision) String() string {
+	return fmt.Sprintf("id-%d", k.ID)
+}
+
+func TestMarshal_DuplicateMapKeys(t *testing.T) {
+	v := map[MapKeyCollision]string{
+		{ID: 1, Version: 1}: "first",
+		{ID: 1, Version: 2}: "second",
+	}
+
+	_, err := Marshal(&Options{}, v)
+	assert.ErrorIs(t, err, ErrDuplicateMapKey)
+	assert.EqualError(t, err, `marshaller: duplicate map key: "id-1" in map[sheriff.MapKeyCollision]string`)
+
+	// distinct string forms are fine
+	_, err = Marshal(&Options{}, map[MapKeyCollision]string{{ID: 1}: "first", {ID: 2}: "second"})
+	assert.NoError(t, err)
+}
+
+func TestMarshal_InvalidTypeErrorAccessors(t *testing.T) {
+	key := AModel{true, true}
+	_, err := Marshal(&Options{}, map[AModel]string{key: "a"})
+
+	var typeErr MarshalInvalidTypeError
+	assert.True(t, errors.As(err, &typeErr))
+	assert.Equal(t, reflect.Struct, typeErr.Kind())
+	assert.Equal(t, key, typeErr.Data())
+	assert.Equal(t, "marshaller: unsupported map key type sheriff.AModel", typeErr.Error())
+}
+
+func TestMarshal_UnsupportedKinds(t *testing.T) {
+	type funcModel struct {
+		Name     string      `json:"name"`
+		Callback func() bool `json:"callback"`
+	}
+	_, err := Marshal(&Options{}, funcModel{Name: "a", Callback: func() bool { return true }})
+	var typeErr MarshalInvalidTypeError
+	assert.True(t, errors.As(err, &typeErr))
+	assert.Equal(t, reflect.Func, typeErr.Kind())
+	assert.EqualError(t, err, "field callback: marshaller: Unable to marshal type func. The kind is not supported by JSON.")
+
+	// nil funcs fail as well, like with encoding/json
+	_, err = Marshal(&Options{}, funcModel{Name: "a"})
+	assert.EqualError(t, err, "field callback: marshaller: Unable to marshal type func. The kind is not supported by JSON.")
+
+	tests := []interface{}{
+		struct{ C chan int }{make(chan int)},
+		struct{ C complex128 }{1 + 2i},
+		struct{ C *complex64 }{new(complex64)},
+	}
+	for _, test := range tests {
+		_, err := Marshal(&Options{}, test)
+		assert.True(t, errors.As(err, &typeErr), "%T", test)
+	}
+
+	// excluded fields are never marshalled
+	type excludedModel struct {
+		Name     string      `json:"name"`
+		Callback func() bool `json:"-"`
+	}
+	_, err = Marshal(&Options{}, excludedModel{Name: "a", Callback: func() bool { return true }})
+	assert.NoError(t, err)
+}
+
+type DefaultGroupsModel struct {
+	Name  string `json:"name" groups:"public,admin"`
+	Email string `json:"email" groups:"public,partner,admin" default_groups:"public=redacted,partner=hidden"`
+	Phone string `json:"phone,omitempty" groups:"public,admin" default_groups:"public=redacted"`
+}
+
+func TestMarshal_DefaultGroups(t *testing.T) {
+	v := DefaultGroupsModel{Name: "alice", Email: "alice@example.com"}
+
+	tests := []struct {
+		groups   []string
+		expected string
+	}{
+		{[]string{"public"}, `{"email":"redacted","name":"alice"}`},
+		{[]string{"partner"}, `{"email":"hidden"}`},
+		{[]string{"admin"}, `{"email":"alice@example.com","name":"alice"}`},
+		{[]string{"admin", "public"}, `{"email":"redacted","name":"alice"}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(&Options{Groups: test.groups}, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), "groups %v", test.groups)
+	}
+}
+
+func TestMarshal_MapsAsEntries(t *testing.T) {
+	v := struct {
+		Names map[string]string  `json:"names"`
+		ByID  map[int]AModel     `json:"by_id"`
+		Enums map[MapKeyEnum]int `json:"enums"`
+		Empty map[string]string  `json:"empty"`
+		Nil   map[int]string     `json:"nil"`
+	}{
+		Names: map[string]string{"b": "bob", "a": "alice"},
+		ByID:  map[int]AModel{10: {true, true}, 2: {false, true}},
+		Enums: map[MapKeyEnum]int{1: 1},
+		Empty: map[string]string{},
+	}
+
+	actualMap, err := Marshal(&Options{MapsAsEntries: true, Groups: []string{"test"}, IncludeEmptyTag: true}, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expected := `{"by_id":[{"key":10,"value":{"something":true}},{"key":2,"value":{"something":false}}],` +
+		`"empty":[],` +
+		`"enums":[{"key":1,"value":1}],` +
+		`"names":[{"key":"a","value":"alice"},{"key":"b","value":"bob"}],` +
+		`"nil":null}`
+	assert.Equal(t, expected, string(actual))
+}
+
+type FieldPathAddress struct {
+	Zip   string            `json:"zip"`
+	Attrs map[AModel]string `json:"attrs"`
+}
+
+type FieldPathUser struct {
+	Name      string             `json:"name"`
+	Addresses []FieldPathAddress `json:"addresses"`
+}
+
+func TestMarshal_FieldPathInError(t *testing.T) {
+	v := struct {
+		User FieldPathUser `json:"user"`
+	}{
+		User: FieldPathUser{
+			Addresses: []FieldPathAddress{
+				{Zip: "8000"},
+				{Zip: "3000"},
+				{Zip: "1000", Attrs: map[AModel]string{{true, true}: "invalid"}},
+			},
+		},
+	}
+
+	_, err := Marshal(&Options{}, v)
+	assert.EqualError(t, err, "field user.addresses[2].attrs: marshaller: unsupported map key type sheriff.AModel")
+
+	var fieldErr *MarshalFieldError
+	assert.True(t, errors.As(err, &fieldErr))
+	assert.Equal(t, "user.addresses[2].attrs", fieldErr.Path)
+
+	var typeErr MarshalInvalidTypeError
+	assert.True(t, errors.As(err, &typeErr))
+	assert.Equal(t, reflect.Struct, typeErr.Kind())
+}
+
+type CustomTagNamesModel struct {
+	Name    string `json:"name" type:"public"`
+	Secret  string `json:"secret" type:"private"`
+	Ignored string `json:"ignored" groups:"public"`
+	Added   string `json:"added" type:"public" from:"2"`
+	Removed string `json:"removed" type:"public" to:"1"`
+	Legacy  string `json:"legacy" type:"public" since:"3"`
+}
+
+func TestMarshal_CustomTagNames(t *testing.T) {
+	v := CustomTagNamesModel{"name", "secret", "ignored", "added", "removed", "legacy"}
+
+	apiVersion, err := version.NewVersion("2")
+	assert.NoError(t, err)
+
+	o := &Options{
+		Groups:     []string{"public"},
+		ApiVersion: apiVersion,
+		GroupName:  "type",
+		SinceName:  "from",
+		UntilName:  "to",
+	}
+
+	actualMap, err := Marshal(o, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"added":"added","legacy":"legacy","name":"name"}`, string(actual))
+
+	// the default tag names are still cached separately
+	actualMap, err = Marshal(&Options{Groups: []string{"public"}, ApiVersion: apiVersion}, v)
+	assert.NoError(t, err)
+
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"ignored":"ignored"}`, string(actual))
+}
+
+type EmptyDefinitionsModel struct {
+	Count   int      `json:"count,omitempty"`
+	Limit   int64    `json:"limit,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Enabled bool     `json:"enabled,omitempty"`
+}
+
+func TestMarshal_EmptyDefinitions(t *testing.T) {
+	o := &Options{
+		EmptyDefinitions: map[reflect.Kind]func(reflect.Value) bool{
+			reflect.Int: func(v reflect.Value) bool {
+				return v.Int() == -1
+			},
+			reflect.Slice: func(v reflect.Value) bool {
+				return v.Len() <= 1
+			},
+		},
+	}
+
+	tests := []struct {
+		v        EmptyDefinitionsModel
+		expected string
+	}{
+		{EmptyDefinitionsModel{Count: -1, Tags: []string{"a"}}, `{}`},
+		{EmptyDefinitionsModel{Count: 0, Tags: []string{"a", "b"}}, `{"count":0,"tags":["a","b"]}`},
+		// kinds without a definition use the default
+		{EmptyDefinitionsModel{Count: 1, Limit: 0, Name: "", Enabled: true}, `{"count":1,"enabled":true}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(o, test.v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual))
+	}
+}
+
+type InheritGroupsAddress struct {
+	Street string `json:"street"`
+	City   string `json:"city"`
+	Notes  string `json:"notes" groups:"internal"`
+}
+
+type InheritGroupsUser struct {
+	Name     string                 `json:"name" groups:"api"`
+	Address  InheritGroupsAddress   `json:"address" groups:"api"`
+	Previous []InheritGroupsAddress `json:"previous" groups:"admin"`
+	Untagged InheritGroupsAddress   `json:"untagged"`
+}
+
+func TestMarshal_InheritFieldGroups(t *testing.T) {
+	address := InheritGroupsAddress{Street: "Main", City: "Zurich", Notes: "notes"}
+	v := InheritGroupsUser{
+		Name:     "alice",
+		Address:  address,
+		Previous: []InheritGroupsAddress{address},
+		Untagged: address,
+	}
+
+	tests := []struct {
+		groups   []string
+		expected string
+	}{
+		{[]string{"api"}, `{"address":{"city":"Zurich","street":"Main"},"name":"alice"}`},
+		{[]string{"admin"}, `{"previous":[{"city":"Zurich","street":"Main"}]}`},
+		{[]string{"api", "internal"}, `{"address":{"city":"Zurich","notes":"notes","street":"Main"},"name":"alice"}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(&Options{Groups: test.groups, InheritFieldGroups: true}, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), "groups %v", test.groups)
+	}
+}
+
+type InheritTagGeo struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng" groups:"precise"`
+}
+
+type InheritTagAddress struct {
+	City string        `json:"city"`
+	Geo  InheritTagGeo `json:"geo"`
+}
+
+type InheritTagUser struct {
+	Name    string            `json:"name" groups:"api"`
+	Address InheritTagAddress `json:"address" groups:"api,inherit"`
+	Billing InheritTagAddress `json:"billing" groups:"api"`
+}
+
+func TestMarshal_InheritGroupsTag(t *testing.T) {
+	address := InheritTagAddress{City: "Zurich", Geo: InheritTagGeo{Lat: 47.3, Lng: 8.5}}
+	v := InheritTagUser{Name: "alice", Address: address, Billing: address}
+
+	tests := []struct {
+		groups   []string
+		expected string
+	}{
+		// the groups cascade over two levels, Billing doesn't inherit without the option
+		{[]string{"api"}, `{"address":{"city":"Zurich","geo":{"lat":47.3}},"billing":{},"name":"alice"}`},
+		// explicitly tagged children keep their groups
+		{[]string{"api", "precise"}, `{"address":{"city":"Zurich","geo":{"lat":47.3,"lng":8.5}},"billing":{},"name":"alice"}`},
+		{[]string{"precise"}, `{}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(&Options{Groups: test.groups}, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), test.groups)
+	}
+}
+
+func TestMarshal_InheritFieldGroupsDisabled(t *testing.T) {
+	v := InheritGroupsUser{Name: "alice", Address: InheritGroupsAddress{Street: "Main", City: "Zurich"}}
+
+	actualMap, err := Marshal(&Options{Groups: []string{"api"}}, v)
+	assert.NoError(t, err)
+
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"address":{},"name":"alice"}`, string(actual))
+}
+
+type TagNameModel struct {
+	UserName string `json:"user_name" yaml:"userName"`
+	Email    string `json:"email,omitempty" yaml:"mail"`
+	Hidden   string `json:"hidden" yaml:"-"`
+	Count    int    `json:"count" yaml:"count,string"`
+	Plain    string
+}
+
+func TestMarshal_TagName(t *testing.T) {
+	v := TagNameModel{UserName: "alice", Hidden: "hidden", Count: 3, Plain: "plain"}
+
+	actualMap, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Plain":"plain","count":3,"hidden":"hidden","user_name":"alice"}`, string(actual))
+
+	actualMap, err = Marshal(&Options{TagName: "yaml"}, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"Plain":"plain","count":"3","mail":"","userName":"alice"}`, string(actual))
+}
+
+type RenameModel struct {
+	UserName string            `json:"user_name" groups:"v1,v2,v3" rename:"v2:username,v3:login"`
+	Tags     []string          `json:"tags" groups:"v1,v2,v3" rename:"v3:labels" maxitems:"1"`
+	Settings map[AModel]string `json:"settings,omitempty" groups:"v3" rename:"v3:preferences"`
+}
+
+func TestMarshal_Rename(t *testing.T) {
+	v := RenameModel{UserName: "alice", Tags: []string{"a", "b"}}
+
+	tests := []struct {
+		groups   []string
+		expected string
+	}{
+		{[]string{"v1"}, `{"tags":["a"],"tags_truncated":true,"user_name":"alice"}`},
+		{[]string{"v2"}, `{"tags":["a"],"tags_truncated":true,"username":"alice"}`},
+		{[]string{"v3"}, `{"labels":["a"],"labels_truncated":true,"login":"alice"}`},
+		// the first requested group wins
+		{[]string{"v3", "v2"}, `{"labels":["a"],"labels_truncated":true,"login":"alice"}`},
+		{[]string{"v2", "v3"}, `{"labels":["a"],"labels_truncated":true,"username":"alice"}`},
+	}
+
+	for _, test := range tests {
+		actualMap, err := Marshal(&Options{Groups: test.groups, MarkTruncated: true}, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), "groups %v", test.groups)
+	}
+
+	// the first rule of the tag wins, regardless of the order of the groups
+	for _, groups := range [][]string{{"v3", "v2"}, {"v2", "v3"}} {
+		actualMap, err := Marshal(&Options{Groups: groups, NameResolution: NameResolutionTagOrder}, v)
+		assert.NoError(t, err)
+
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"labels":["a"],"username":"alice"}`, string(actual), "groups %v", groups)
+	}
+
+	// error paths use the renamed key
+	v.Settings = map[AModel]string{{true, true}: "invalid"}
+	_, err := Marshal(&Options{Groups: []string{"v3"}}, v)
+	assert.EqualError(t, err, "field preferences: marshaller: unsupported map key type sheriff.AModel")
+}
+
+type RedactModel struct {
+	User     string  `json:"user"`
+	Password string  `json:"password" redact:"true"`
+	Card     *AModel `json:"card" redact:"true"`
+	Token    string  `json:"token,omitempty" redact:"true"`
+	Internal string  `json:"internal" groups:"internal" redact:"true"`
+}
+
+func TestMarshal_Redact(t *testing.T) {
+	v := RedactModel{User: "alice", Password: "secret", Card: &AModel{true, true}, Internal: "internal"}
+
+	actualMap, err := Marshal(&Options{Redact: true}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"card":"[REDACTED]","internal":"[REDACTED]","password":"[REDACTED]","user":"alice"}`, string(actual))
+
+	// without Redact the values are marshalled
+	actualMap, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"card":{"something":true,"something_else":true},"internal":"internal","password":"secret","user":"alice"}`, string(actual))
+}
+
+func TestMarshal_RedactWith(t *testing.T) {
+	o := &Options{
+		Redact:          true,
+		Groups:          []string{"api"},
+		IncludeEmptyTag: true,
+		RedactWith: func(field reflect.StructField) interface{} {
+			return "***" + field.Name
+		},
+	}
+
+	actualMap, err := Marshal(o, RedactModel{User: "alice", Password: "secret", Token: "token", Internal: "internal"})
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	// groups still remove the key entirely
+	assert.Equal(t, `{"card":"***Card","password":"***Password","token":"***Token","user":"alice"}`, string(actual))
+}
+
+type Optional[T any] struct {
+	Value   T
+	Present bool
+}
+
+type OptionalModel struct {
+	Name     Optional[string] `json:"name"`
+	Nickname Optional[string] `json:"nickname"`
+	Email    Optional[string] `json:"email,omitempty"`
+	Age      Optional[int]    `json:"age,omitempty"`
+}
+
+func TestMarshal_UnwrapOptionals(t *testing.T) {
+	v := OptionalModel{
+		Name: Optional[string]{Value: "alice", Present: true},
+		Age:  Optional[int]{Value: 0, Present: true},
+	}
+
+	m, err := Marshal(&Options{UnwrapOptionals: true}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"age":0,"name":"alice","nickname":null}`, string(d))
+
+	m, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"age":{"Present":true,"Value":0},"email":{"Present":false,"Value":""},"name":{"Present":true,"Value":"alice"},"nickname":{"Present":false,"Value":""}}`, string(d))
+}
+
+func TestMarshal_ValueTransformer(t *testing.T) {
+	type testStruct struct {
+		Name   string            `json:"name"`
+		Email  string            `json:"email"`
+		Count  int               `json:"count"`
+		Nested map[string]string `json:"nested"`
+	}
+	v := testStruct{Name: "alice", Email: "alice@example.com", Count: 3, Nested: map[string]string{"a": "b"}}
+
+	var fields []string
+	o := &Options{
+		ValueTransformer: func(field reflect.StructField, value interface{}) (interface{}, error) {
+			fields = append(fields, field.Name)
+			if s, ok := value.(string); ok {
+				return strings.ToUpper(s), nil
+			}
+			return value, nil
+		},
+	}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"count":3,"email":"ALICE@EXAMPLE.COM","name":"ALICE","nested":{"a":"b"}}`, string(d))
+	assert.Equal(t, []string{"Name", "Email", "Count"}, fields)
+
+	o.ValueTransformer = func(field reflect.StructField, value interface{}) (interface{}, error) {
+		return nil, errors.New("transform failed")
+	}
+	_, err = Marshal(o, v)
+	assert.EqualError(t, err, "field name: transform failed")
+}
+
+type ArrayPoint struct {
+	X int `json:"x" groups:"api"`
+	Y int `json:"y" groups:"api"`
+	Z int `json:"z" groups:"internal"`
+}
+
+func TestMarshal_Array(t *testing.T) {
+	type testStruct struct {
+		Points [2]ArrayPoint `json:"points" groups:"api"`
+		Empty  [0]ArrayPoint `json:"empty" groups:"api"`
+		Bytes  [2]byte       `json:"bytes" groups:"api"`
+	}
+	v := testStruct{
+		Points: [2]ArrayPoint{{X: 1, Y: 2, Z: 3}, {X: 4, Y: 5, Z: 6}},
+		Bytes:  [2]byte{1, 2},
+	}
+
+	m, err := Marshal(&Options{Groups: []string{"api"}}, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"bytes":[1,2],"empty":[],"points":[{"x":1,"y":2},{"x":4,"y":5}]}`, string(d))
+
+	m, err = Marshal(&Options{Groups: []string{"api"}}, v.Points)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"x":1,"y":2},{"x":4,"y":5}]`, string(d))
+}
+
+type Money int
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(int(m))
+}
+
+func TestMarshal_TypeMarshallers(t *testing.T) {
+	type testStruct struct {
+		Price    Money       `json:"price"`
+		Discount Money       `json:"discount"`
+		Tip      *Money      `json:"tip"`
+		Total    interface{} `json:"total"`
+		History  []Money     `json:"history"`
+	}
+	formatMoney := func(value interface{}) (interface{}, error) {
+		m := value.(Money)
+		return fmt.Sprintf("%d.%02d CHF", m/100, m%100), nil
+	}
+	o := &Options{
+		TypeMarshallers: map[reflect.Type]func(value interface{}) (interface{}, error){
+			reflect.TypeOf(Money(0)): formatMoney,
+			reflect.TypeOf((*Money)(nil)): func(value interface{}) (interface{}, error) {
+				if m := value.(*Money); m != nil {
+					return formatMoney(*m)
+				}
+				return "0.00 CHF", nil
+			},
+		},
+	}
+	v := testStruct{Price: 1250, Total: Money(1050), History: []Money{5, 100}}
+
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"discount":"0.00 CHF","history":["0.05 CHF","1.00 CHF"],"price":"12.50 CHF","tip":"0.00 CHF","total":"10.50 CHF"}`, string(d))
+
+	m, err = Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"discount":0,"history":[5,100],"price":1250,"tip":null,"total":1050}`, string(d))
+}
+
+func TestMarshal_MapKeySortStableHash(t *testing.T) {
+	v := map[string]int{"a": 1, "b": 2, "c": 3, "d": 4, "e": 5}
+	o := &Options{MapKeySort: MapKeySortStableHash, KVStoreFactory: NewOrderedKVStore}
+
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	// the order only depends on the keys, so it is the same across runs and processes
+	assert.Equal(t, `{"e":5,"d":4,"a":1,"c":3,"b":2}`, string(d))
+
+	for i := 0; i < 10; i++ {
+		m, err = Marshal(o, v)
+		assert.NoError(t, err)
+		again, err := json.Marshal(m)
+		assert.NoError(t, err)
+		assert.Equal(t, string(d), string(again))
+	}
+
+	_, err = Marshal(&Options{MapKeySort: "random"}, v)
+	assert.EqualError(t, err, `marshaller: unknown MapKeySort "random"`)
+}
+
+type BinaryAmount struct {
+	Units int64 `json:"units" groups:"internal"`
+	Nanos int32 `json:"nanos" groups:"internal"`
+}
+
+func (a BinaryAmount) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d.%09d", a.Units, a.Nanos)), nil
+}
+
+// BinaryDigits is a scalar type implementing only encoding.BinaryMarshaler.
+type BinaryDigits int64
+
+func (d BinaryDigits) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprint(int64(d))), nil
+}
+
+type BinaryItem struct {
+	Public string `json:"public" groups:"api"`
+	Secret string `json:"secret" groups:"admin"`
+}
+
+// BinaryItems is a slice type implementing only encoding.BinaryMarshaler.
+type BinaryItems []BinaryItem
+
+func (i BinaryItems) MarshalBinary() ([]byte, error) {
+	return []byte(fmt.Sprint([]BinaryItem(i))), nil
+}
+
+func TestMarshal_BinaryMarshalerAndNumber(t *testing.T) {
+	type testStruct struct {
+		Number  json.Number    `json:"number" groups:"api"`
+		Digits  BinaryDigits   `json:"digits" groups:"api"`
+		Amount  BinaryAmount   `json:"amount" groups:"api"`
+		Amounts []BinaryAmount `json:"amounts" groups:"api"`
+	}
+	v := testStruct{
+		Number:  json.Number("12345678901234567890.12"),
+		Digits:  BinaryDigits(123),
+		Amount:  BinaryAmount{Units: 1, Nanos: 5},
+		Amounts: []BinaryAmount{{Units: 2}},
+	}
+	o := &Options{
+		Groups:         []string{"api"},
+		ValueRedactors: []ValueRedactor{{Pattern: regexp.MustCompile(`\d`), Replacement: "x"}},
+	}
+
+	actualMap, err := Marshal(o, v)
+	assert.NoError(t, err)
+	assert.Equal(t, json.Number("12345678901234567890.12"), actualMap.(kvStore)["number"])
+	assert.Equal(t, BinaryDigits(123), actualMap.(kvStore)["digits"])
+
+	// structs implementing encoding.BinaryMarshaler are filtered like any other struct
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"number":12345678901234567890.12,"digits":123,"amount":{},"amounts":[{}]}`, string(actual))
+
+	o.Groups = []string{"api", "internal"}
+	actualMap, err = Marshal(o, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(actual))
+}
+
+func TestMarshal_BinaryMarshalerSlice(t *testing.T) {
+	type testStruct struct {
+		Items BinaryItems `json:"items" groups:"api"`
+	}
+	v := testStruct{Items: BinaryItems{{Public: "p", Secret: "s"}}}
+
+	actualMap, err := Marshal(&Options{Groups: []string{"api"}}, v)
+	assert.NoError(t, err)
+
+	// slices implementing encoding.BinaryMarshaler are filtered element by element
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"items":[{"public":"p"}]}`, string(actual))
+}
+
+func TestMarshal_MaxTotalElements(t *testing.T) {
+	type leaf struct {
+		A int `json:"a"`
+		B int `json:"b"`
+	}
+	type node struct {
+		Leaves []leaf          `json:"leaves"`
+		ByName map[string]leaf `json:"by_name"`
+	}
+	// every node emits 2 fields, 10 leaves and 1 map value with 2 fields each
+	nodes := make([]node, 10)
+	for i := range nodes {
+		nodes[i] = node{Leaves: make([]leaf, 10), ByName: map[string]leaf{"x": {}}}
+	}
+	perNode := 1 + 2 + 10*3 + 1*3
+
+	_, err := Marshal(&Options{MaxTotalElements: 10 * perNode}, nodes)
+	assert.NoError(t, err)
+
+	_, err = Marshal(&Options{MaxTotalElements: 10*perNode - 1}, nodes)
+	assert.ErrorIs(t, err, ErrTooManyElements)
+	assert.EqualError(t, err, "field [9].by_name.x.b: marshaller: too many elements: limit is 359")
+
+	// the limit is shared by the workers marshalling in parallel
+	many := make([]leaf, 1000)
+	_, err = Marshal(&Options{MaxTotalElements: 2999, Parallelism: 4}, many)
+	assert.ErrorIs(t, err, ErrTooManyElements)
+	_, err = Marshal(&Options{MaxTotalElements: 3000, Parallelism: 4}, many)
+	assert.NoError(t, err)
+}
+
+func TestMarshal_MaxTotalElementsParallel(t *testing.T) {
+	many := make([]int, 1000)
+	for i := range many {
+		many[i] = i
+	}
+
+	tests := []struct {
+		options *Options
+		err     bool
+	}{
+		// the elements dropped by DefaultMaxItems don't count against the limit
+		{&Options{DefaultMaxItems: 10, MaxTotalElements: 50}, false},
+		{&Options{DefaultMaxItems: 10, MaxTotalElements: 9}, true},
+		{&Options{MaxTotalElements: 1000}, false},
+		{&Options{MaxTotalElements: 999}, true},
+	}
+
+	for _, test := range tests {
+		sequential, err := Marshal(test.options, many)
+		if test.err {
+			assert.ErrorIs(t, err, ErrTooManyElements)
+		} else {
+			assert.NoError(t, err)
+		}
+
+		o := *test.options
+		o.Parallelism = 4
+		parallel, err := Marshal(&o, many)
+		if test.err {
+			assert.ErrorIs(t, err, ErrTooManyElements)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, sequential, parallel)
+	}
+}
+
+type ValidatedAddress struct {
+	Zip string `json:"zip"`
+}
+
+func (a *ValidatedAddress) Validate() error {
+	if len(a.Zip) != 4 {
+		return fmt.Errorf("invalid zip %q", a.Zip)
+	}
+	return nil
+}
+
+type ValidatedUser struct {
+	Name      string             `json:"name"`
+	Addresses []ValidatedAddress `json:"addresses"`
+}
+
+func (u ValidatedUser) Validate() error {
+	if u.Name == "" {
+		return errors.New("name is required")
+	}
+	return nil
+}
+
+func TestMarshal_ValidateBeforeMarshal(t *testing.T) {
+	valid := ValidatedUser{Name: "alice", Addresses: []ValidatedAddress{{Zip: "8000"}}}
+	actualMap, err := Marshal(&Options{ValidateBeforeMarshal: true}, valid)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"addresses":[{"zip":"8000"}],"name":"alice"}`, string(actual))
+
+	_, err = Marshal(&Options{ValidateBeforeMarshal: true}, ValidatedUser{})
+	assert.EqualError(t, err, "name is required")
+
+	invalid := []ValidatedUser{valid, {Name: "bob", Addresses: []ValidatedAddress{{Zip: "8000"}, {Zip: "80"}}}}
+	_, err = Marshal(&Options{ValidateBeforeMarshal: true}, invalid)
+	assert.EqualError(t, err, `field [1].addresses[1]: invalid zip "80"`)
+
+	// without the option the data isn't validated
+	_, err = Marshal(&Options{}, invalid)
+	assert.NoError(t, err)
+}
+
+func TestMarshal_DefaultGroupsOption(t *testing.T) {
+	v := struct {
+		Username string `json:"username" groups:"public,admin"`
+		Email    string `json:"email" groups:"admin"`
+		Untagged string `json:"untagged"`
+	}{"alice", "alice@example.com", "untagged"}
+
+	marshal := func(o *Options) string {
+		actualMap, err := Marshal(o, v)
+		assert.NoError(t, err)
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		return string(actual)
+	}
+
+	public := marshal(&Options{Groups: []string{"public"}})
+	assert.Equal(t, `{"username":"alice"}`, public)
+	assert.Equal(t, public, marshal(&Options{DefaultGroups: []string{"public"}}))
+	// requested groups take precedence over the default ones
+	assert.Equal(t, `{"email":"alice@example.com","username":"alice"}`, marshal(&Options{Groups: []string{"admin"}, DefaultGroups: []string{"public"}}))
+	// without any groups, the group tags are ignored
+	assert.Equal(t, `{"email":"alice@example.com","untagged":"untagged","username":"alice"}`, marshal(&Options{}))
+}
+
+type ReservedDocument struct {
+	ID    int    `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+}
+
+func TestMarshal_ReservedKeys(t *testing.T) {
+	v := struct {
+		ReservedDocument
+		Children []ReservedDocument `json:"children"`
+	}{ReservedDocument{1, "page", "Home"}, []ReservedDocument{{2, "page", "About"}}}
+
+	actualMap, err := Marshal(&Options{ReservedKeys: []string{"id", "type"}, ReservedPrefix: "doc_"}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"children":[{"doc_id":2,"doc_type":"page","title":"About"}],"doc_id":1,"doc_type":"page","title":"Home"}`, string(actual))
+
+	actualMap, err = Marshal(&Options{ReservedKeys: []string{"id"}}, v.ReservedDocument)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"_id":1,"title":"Home","type":"page"}`, string(actual))
+}
+
+type GroupAliasesModel struct {
+	ID        int    `json:"id" groups:"core"`
+	Title     string `json:"title" groups:"list"`
+	Thumbnail string `json:"thumbnail" groups:"thumbnail"`
+	Body      string `json:"body" groups:"detail"`
+	Badge     string `json:"badge" groups:"mobile"`
+}
+
+func TestMarshal_GroupAliases(t *testing.T) {
+	v := GroupAliasesModel{ID: 1, Title: "title", Thumbnail: "thumb.png", Body: "body", Badge: "new"}
+	aliases := map[string][]string{
+		"mobile": {"core", "list", "thumbnail"},
+		"tablet": {"mobile", "detail"},
+		// cyclic aliases are expanded once
+		"a": {"b"},
+		"b": {"a", "core"},
+	}
+
+	tests := []struct {
+		groups   []string
+		expected string
+	}{
+		{[]string{"mobile"}, `{"badge":"new","id":1,"thumbnail":"thumb.png","title":"title"}`},
+		{[]string{"tablet"}, `{"badge":"new","body":"body","id":1,"thumbnail":"thumb.png","title":"title"}`},
+		{[]string{"a"}, `{"id":1}`},
+		{[]string{"list"}, `{"title":"title"}`},
+	}
+	for _, test := range tests {
+		actualMap, err := Marshal(&Options{Groups: test.groups, GroupAliases: aliases}, v)
+		assert.NoError(t, err)
+		actual, err := json.Marshal(actualMap)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, string(actual), test.groups)
+	}
+}
+
+func TestOptions_Clone(t *testing.T) {
+	o := &Options{
+		Groups:       []string{"api"},
+		GroupKeyDeny: map[string][]string{"api": {"*_internal"}},
+		ComputedFields: map[reflect.Type][]ComputedField{
+			reflect.TypeOf(AModel{}): {{Name: "computed", Compute: func(value interface{}, options *Options) (interface{}, error) {
+				return "value", nil
+			}}},
+		},
+	}
+	v := AModel{AllGroups: true, TestGroup: true}
+
+	c := o.Clone()
+	c.Groups[0] = "admin"
+	c.Groups = append(c.Groups, "internal")
+	c.GroupKeyDeny["api"][0] = "*"
+	c.GroupKeyDeny["admin"] = []string{"*"}
+	c.ComputedFields[reflect.TypeOf(AModel{})][0].Name = "changed"
+	c.IncludeEmptyTag = true
+
+	assert.Equal(t, []string{"api"}, o.Groups)
+	assert.Equal(t, map[string][]string{"api": {"*_internal"}}, o.GroupKeyDeny)
+	assert.Equal(t, "computed", o.ComputedFields[reflect.TypeOf(AModel{})][0].Name)
+	assert.False(t, o.IncludeEmptyTag)
+
+	c.Groups = []string{"test-other"}
+	actualMap, err := Marshal(c, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"changed":"value","something_else":true}`, string(actual))
+	assert.Nil(t, c.FieldFilter)
+
+	o.Groups = []string{"test"}
+	actualMap, err = Marshal(o.Clone(), v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"computed":"value","something":true}`, string(actual))
+}
+
+type DeepMergeEmbedded struct {
+	Labels map[string]interface{} `json:"labels"`
+	Name   string                 `json:"name"`
+}
+
+type DeepMergeModel struct {
+	DeepMergeEmbedded
+	Labels map[string]interface{} `json:"labels"`
+}
+
+func TestMarshal_DeepMergeFlattenedMaps(t *testing.T) {
+	v := DeepMergeModel{
+		DeepMergeEmbedded: DeepMergeEmbedded{
+			Labels: map[string]interface{}{"team": "core", "nested": map[string]string{"a": "embedded", "b": "embedded"}},
+			Name:   "embedded",
+		},
+		Labels: map[string]interface{}{"env": "prod", "nested": map[string]string{"a": "top"}},
+	}
+
+	actualMap, err := Marshal(&Options{}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"labels":{"env":"prod","nested":{"a":"top"}},"name":"embedded"}`, string(actual))
+
+	actualMap, err = Marshal(&Options{DeepMergeFlattenedMaps: true}, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"labels":{"env":"prod","nested":{"a":"top","b":"embedded"},"team":"core"},"name":"embedded"}`, string(actual))
+}
+
+func TestMarshal_PointerToPointer(t *testing.T) {
+	type pointerModel struct {
+		Name   **string           `json:"name" groups:"test"`
+		Nil    **string           `json:"nil" groups:"test"`
+		Model  **TestGroupsModel  `json:"model" groups:"test"`
+		Triple ***TestGroupsModel `json:"triple" groups:"test"`
+	}
+	name := "alice"
+	namePtr := &name
+	var nilPtr *string
+	model := &TestGroupsModel{DefaultMarshal: "default", OnlyGroupTest: "test", OnlyGroupTestOther: "other"}
+	modelPtr := &model
+
+	v := pointerModel{Name: &namePtr, Nil: &nilPtr, Model: &model, Triple: &modelPtr}
+	actualMap, err := Marshal(&Options{Groups: []string{"test"}}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+
+	expectedModel := `{"group_test_and_other":"","only_group_test":"test"}`
+	assert.JSONEq(t, `{"name":"alice","nil":null,"model":`+expectedModel+`,"triple":`+expectedModel+`}`, string(actual))
+}
+
+func TestMarshal_MapKeyTransformer(t *testing.T) {
+	type headersModel struct {
+		Headers map[string]string `json:"headers"`
+	}
+	v := headersModel{Headers: map[string]string{"Content-Type": "text/plain", "X-Request-ID": "42"}}
+
+	actualMap, err := Marshal(&Options{MapKeyTransformer: strings.ToLower}, v)
+	assert.NoError(t, err)
+	actual, err := json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"headers":{"content-type":"text/plain","x-request-id":"42"}}`, string(actual))
+
+	// struct fields are not affected
+	actualMap, err = Marshal(&Options{MapKeyTransformer: strings.ToUpper}, v)
+	assert.NoError(t, err)
+	actual, err = json.Marshal(actualMap)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"headers":{"CONTENT-TYPE":"text/plain","X-REQUEST-ID":"42"}}`, string(actual))
+
+	v.Headers["content-type"] = "application/json"
+	_, err = Marshal(&Options{MapKeyTransformer: strings.ToLower}, v)
+	assert.ErrorIs(t, err, ErrDuplicateMapKey)
+	assert.Contains(t, err.Error(), `are both transformed to "content-type" in map[string]string`)
+}
@@ -0,0 +1,105 @@
+package sheriff
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// marshalSlice marshals every element of the slice or array v which passes the ElementFilter.
+// If maxItems is greater than 0, only the first maxItems included elements are marshalled and
+// the second return value reports whether elements have been dropped because of it.
+func marshalSlice(options *Options, v reflect.Value, maxItems int) (interface{}, bool, error) {
+	l := v.Len()
+	// arrays are values, only slices can be part of a cycle
+	if l > 0 && v.Kind() == reflect.Slice {
+		visit := visitKey{ptr: v.Pointer(), t: v.Type(), len: l}
+		if err := options.state.enter(visit); err != nil {
+			return nil, false, err
+		}
+		defer options.state.leave(visit)
+	}
+	dest := make([]interface{}, l)
+	included := make([]bool, l)
+	n := 0
+	for i := 0; i < l; i++ {
+		include, err := includeElement(options, i, v.Index(i))
+		if err != nil {
+			return nil, false, err
+		}
+		if !include {
+			continue
+		}
+		if maxItems > 0 && n == maxItems {
+			d, _ := assembleSlice(options, dest, included, maxItems)
+			return d, true, nil
+		}
+		options.state.enterIndex(i)
+		d, err := marshalElement(options, v.Index(i))
+		options.state.leavePath()
+		if err != nil {
+			return nil, false, wrapFieldError(err, "["+strconv.Itoa(i)+"]")
+		}
+		dest[i] = d
+		included[i] = true
+		n++
+	}
+	d, _ := assembleSlice(options, dest, included, maxItems)
+	return d, false, nil
+}
+
+// marshalElement marshals an element of a slice or a value of a map, counting it against options.MaxTotalElements.
+func marshalElement(options *Options, v reflect.Value) (interface{}, error) {
+	if err := countElement(options); err != nil {
+		return nil, err
+	}
+	if options.NilBoolInMapAs != nil && v.Kind() == reflect.Ptr && v.IsNil() && v.Type().Elem().Kind() == reflect.Bool {
+		return options.NilBoolInMapAs, nil
+	}
+	return marshalValue(options, v)
+}
+
+// includeElement decides whether the element at index i of a slice should be marshalled using options.ElementFilter.
+func includeElement(options *Options, i int, v reflect.Value) (bool, error) {
+	if options.ElementFilter == nil {
+		return true, nil
+	}
+	return options.ElementFilter(i, v)
+}
+
+// assembleSlice builds the output of a marshalled slice from its marshalled elements.
+// Elements which haven't been included are dropped, or leave a gap in the index keys
+// if options.SlicesAsIndexedObjects is set. If maxItems is greater than 0, only the first
+// maxItems included elements are kept and the second return value reports whether elements have been dropped.
+func assembleSlice(options *Options, elements []interface{}, included []bool, maxItems int) (interface{}, bool) {
+	truncated := false
+	n := 0
+	for i := range elements {
+		if !included[i] {
+			continue
+		}
+		if maxItems > 0 && n == maxItems {
+			included[i] = false
+			truncated = true
+			continue
+		}
+		n++
+	}
+
+	if options.SlicesAsIndexedObjects {
+		dest := options.KVStoreFactory()
+		for i, e := range elements {
+			if included[i] {
+				dest.Set(strconv.Itoa(i), e)
+			}
+		}
+		return dest, truncated
+	}
+
+	dest := elements[:0]
+	for i, e := range elements {
+		if included[i] {
+			dest = append(dest, e)
+		}
+	}
+	return dest, truncated
+}
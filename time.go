@@ -0,0 +1,108 @@
+package sheriff
+
+import (
+	"fmt"
+	"time"
+)
+
+// timeFormatRelative is the value of the `timeformat` tag rendering a time relative to now, e.g. "3 hours ago".
+const timeFormatRelative = "relative"
+
+// TimeLayoutUnix is the value of Options.TimeLayout marshalling times as unix timestamps in seconds.
+const TimeLayoutUnix = "unix"
+
+// asTime returns the time.Time held by val, which is either a time.Time or a non-nil *time.Time.
+func asTime(val interface{}) (time.Time, bool) {
+	switch t := val.(type) {
+	case time.Time:
+		return t, true
+	case *time.Time:
+		if t != nil {
+			return *t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// marshalTime formats t according to the passed format, which is either the `timeformat` tag of the field
+// or empty to use the options. The second return value is false if the time isn't formatted by sheriff.
+//
+// The `timeformat` tag takes precedence over the options, TimeAsObject takes precedence over RelativeTime,
+// which takes precedence over TimeLayout.
+func marshalTime(options *Options, format string, t time.Time) (interface{}, bool) {
+	switch {
+	case format == timeFormatRelative || format == "" && !options.TimeAsObject && options.RelativeTime:
+		if t.IsZero() {
+			return nil, true
+		}
+		return relativeTime(t, options.now()), true
+	case format == "" && options.TimeAsObject:
+		if t.IsZero() {
+			return nil, true
+		}
+		return timeObject(options, t), true
+	case format == "" && options.TimeLayout == TimeLayoutUnix:
+		return t.Unix(), true
+	case format == "" && options.TimeLayout != "":
+		return t.Format(options.TimeLayout), true
+	}
+	return nil, false
+}
+
+// timeObject returns t as an object containing the RFC 3339 and the unix representation.
+func timeObject(options *Options, t time.Time) KVStore {
+	isoKey, unixKey := options.TimeObjectKeys.ISO, options.TimeObjectKeys.Unix
+	if isoKey == "" {
+		isoKey = "iso"
+	}
+	if unixKey == "" {
+		unixKey = "unix"
+	}
+
+	dest := options.KVStoreFactory()
+	dest.Set(isoKey, t.Format(time.RFC3339Nano))
+	dest.Set(unixKey, t.Unix())
+	return dest
+}
+
+// now returns the current time using options.Now if set.
+func (o *Options) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
+// relativeTime humanizes the duration between t and now, e.g. "3 hours ago" or "in 2 days".
+func relativeTime(t time.Time, now time.Time) string {
+	d := now.Sub(t)
+	future := d < 0
+	if future {
+		d = -d
+	}
+
+	var n int64
+	var unit string
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		n, unit = int64(d/time.Minute), "minute"
+	case d < 24*time.Hour:
+		n, unit = int64(d/time.Hour), "hour"
+	case d < 30*24*time.Hour:
+		n, unit = int64(d/(24*time.Hour)), "day"
+	case d < 365*24*time.Hour:
+		n, unit = int64(d/(30*24*time.Hour)), "month"
+	default:
+		n, unit = int64(d/(365*24*time.Hour)), "year"
+	}
+	if n != 1 {
+		unit += "s"
+	}
+
+	if future {
+		return fmt.Sprintf("in %d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %s ago", n, unit)
+}
@@ -0,0 +1,144 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ActivityModel struct {
+	CreatedAt time.Time  `json:"created_at" timeformat:"relative"`
+	UpdatedAt *time.Time `json:"updated_at" timeformat:"relative"`
+	DeletedAt *time.Time `json:"deleted_at" timeformat:"relative"`
+	Absolute  time.Time  `json:"absolute"`
+}
+
+func TestRelativeTime(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		t        time.Time
+		expected string
+	}{
+		{now, "just now"},
+		{now.Add(-30 * time.Second), "just now"},
+		{now.Add(-1 * time.Minute), "1 minute ago"},
+		{now.Add(-3 * time.Hour), "3 hours ago"},
+		{now.Add(-25 * time.Hour), "1 day ago"},
+		{now.Add(-45 * 24 * time.Hour), "1 month ago"},
+		{now.Add(-800 * 24 * time.Hour), "2 years ago"},
+		{now.Add(2 * 24 * time.Hour), "in 2 days"},
+		{now.Add(5 * time.Minute), "in 5 minutes"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, relativeTime(test.t, now))
+	}
+}
+
+func TestMarshal_RelativeTime(t *testing.T) {
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	updated := now.Add(3 * time.Hour)
+	v := ActivityModel{
+		CreatedAt: now.Add(-3 * time.Hour),
+		UpdatedAt: &updated,
+		Absolute:  now,
+	}
+
+	o := &Options{
+		Now: func() time.Time {
+			return now
+		},
+	}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"absolute":"2024-05-10T12:00:00Z","created_at":"3 hours ago","deleted_at":null,"updated_at":"in 3 hours"}`, string(d))
+
+	o.RelativeTime = true
+	v.CreatedAt = time.Time{}
+	m, err = Marshal(o, v)
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"absolute":"just now","created_at":null,"deleted_at":null,"updated_at":"in 3 hours"}`, string(d))
+
+	m, err = Marshal(o, []time.Time{now.Add(-48 * time.Hour)})
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `["2 days ago"]`, string(d))
+}
+
+func TestMarshal_TimeAsObject(t *testing.T) {
+	created := time.Date(2017, 1, 20, 18, 11, 0, 0, time.UTC)
+	v := ActivityModel{
+		CreatedAt: created,
+		UpdatedAt: &created,
+		Absolute:  created,
+	}
+
+	o := &Options{TimeAsObject: true}
+	m, err := Marshal(o, v)
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	// the timeformat tag takes precedence
+	assert.Contains(t, string(d), `"absolute":{"iso":"2017-01-20T18:11:00Z","unix":1484935860}`)
+	assert.Contains(t, string(d), `"deleted_at":null`)
+	assert.NotContains(t, string(d), `"created_at":{`)
+
+	type times struct {
+		Created time.Time  `json:"created"`
+		Pointer *time.Time `json:"pointer"`
+		Nil     *time.Time `json:"nil"`
+		Zero    time.Time  `json:"zero"`
+	}
+	o = &Options{TimeAsObject: true, RelativeTime: true, TimeObjectKeys: TimeObjectKeys{ISO: "rfc3339", Unix: "epoch"}}
+	m, err = Marshal(o, times{Created: created, Pointer: &created})
+	assert.NoError(t, err)
+	d, err = json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"created":{"epoch":1484935860,"rfc3339":"2017-01-20T18:11:00Z"},"nil":null,"pointer":{"epoch":1484935860,"rfc3339":"2017-01-20T18:11:00Z"},"zero":null}`, string(d))
+}
+
+type TimeLayoutModel struct {
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Zero      time.Time  `json:"zero,omitempty"`
+}
+
+func TestMarshal_TimeLayout(t *testing.T) {
+	created := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	updated := created.Add(90 * time.Minute)
+	v := TimeLayoutModel{CreatedAt: created, UpdatedAt: &updated}
+
+	tests := []struct {
+		layout   string
+		expected string
+	}{
+		{time.RFC3339, `{"created_at":"2024-05-10T12:00:00Z","updated_at":"2024-05-10T13:30:00Z","zero":"0001-01-01T00:00:00Z"}`},
+		{"02.01.2006 15:04", `{"created_at":"10.05.2024 12:00","updated_at":"10.05.2024 13:30","zero":"01.01.0001 00:00"}`},
+		{TimeLayoutUnix, `{"created_at":1715342400,"updated_at":1715347800,"zero":-62135596800}`},
+	}
+	for _, test := range tests {
+		t.Run(test.layout, func(t *testing.T) {
+			m, err := Marshal(&Options{TimeLayout: test.layout}, v)
+			assert.NoError(t, err)
+			d, err := json.Marshal(m)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, string(d))
+		})
+	}
+
+	// the timeformat tag takes precedence
+	m, err := Marshal(&Options{TimeLayout: TimeLayoutUnix, Now: func() time.Time { return created }}, ActivityModel{CreatedAt: created})
+	assert.NoError(t, err)
+	d, err := json.Marshal(m)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"absolute":-62135596800,"created_at":"just now","deleted_at":null,"updated_at":null}`, string(d))
+}
@@ -0,0 +1,182 @@
+package sheriff
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+// Unmarshal decodes the JSON data into dest, which has to be a non-nil pointer to a struct.
+//
+// Only the fields which Marshal would have emitted using the same options are assigned, all other fields of dest are
+// left untouched. This includes the groups inherited with InheritFieldGroups and the keys denied by GroupKeyDeny.
+// This allows loading group filtered JSON back into a partially populated struct. Nested structs are decoded field
+// by field the same way, while the values of slices and maps are decoded as a whole.
+//
+// Fields whose output can't be reversed are skipped, e.g. fields using the `via` tag, the `default_groups` tag for
+// a requested group, `timeformat:"relative"` or redacted fields. Options transforming the output as a whole, like
+// TimeAsObject, TimeLayout or Compact, aren't reversed.
+func Unmarshal(options *Options, data []byte, dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("sheriff: Unmarshal requires a non-nil pointer to a struct")
+	}
+	return unmarshalStruct(options.withState(), data, v.Elem())
+}
+
+// unmarshalStruct decodes the JSON object data into the fields of the struct v which pass the filter.
+func unmarshalStruct(options *Options, data []byte, v reflect.Value) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	if object == nil {
+		// null leaves the struct untouched
+		return nil
+	}
+	_, err := unmarshalFields(options, object, v)
+	return err
+}
+
+// unmarshalFields assigns the values of object to the fields of the struct v which pass the filter.
+// It reports whether any field has been assigned.
+func unmarshalFields(options *Options, object map[string]json.RawMessage, v reflect.Value) (bool, error) {
+	assigned := false
+	ti := typeInfoOf(options, v.Type())
+	for i := range ti.fields {
+		fi := &ti.fields[i]
+		field := fi.field
+		val := v.Field(i)
+
+		if fi.skip || !val.CanSet() || fi.via != "" || fi.timeFormat == timeFormatRelative || options.Redact && fi.redact {
+			continue
+		}
+		if _, ok := fi.groupDefaultValue(options); ok {
+			continue
+		}
+
+		isEmbeddedField := field.Anonymous && indirectType(field.Type).Kind() == reflect.Struct
+		include, err := selectField(options, fi, val, isEmbeddedField)
+		if err != nil {
+			return false, err
+		}
+		if !include {
+			continue
+		}
+
+		// embedded structs without a json name have been flattened into the object
+		if isEmbeddedField && !fi.hasJSONName {
+			ok, err := unmarshalEmbedded(options, object, val)
+			if err != nil {
+				return false, err
+			}
+			assigned = assigned || ok
+			continue
+		}
+
+		key := outputKey(options, fi)
+		raw, ok := object[key]
+		if !ok || isKeyDenied(options, key) {
+			continue
+		}
+		inheritedGroups := inheritFieldGroups(options, fi, isEmbeddedField)
+		err = unmarshalField(options, fi, raw, val)
+		options.state.inheritedGroups = inheritedGroups
+		if err != nil {
+			return false, wrapFieldError(err, key)
+		}
+		assigned = true
+	}
+	return assigned, nil
+}
+
+// unmarshalEmbedded assigns the values of object to the fields of the embedded struct val.
+// A nil pointer to an embedded struct is only allocated if one of its fields is assigned, otherwise it stays nil.
+func unmarshalEmbedded(options *Options, object map[string]json.RawMessage, val reflect.Value) (bool, error) {
+	if val.Kind() != reflect.Ptr || !val.IsNil() {
+		return unmarshalFields(options, object, allocate(val))
+	}
+	embedded := reflect.New(val.Type().Elem())
+	assigned, err := unmarshalFields(options, object, embedded.Elem())
+	if assigned {
+		val.Set(embedded)
+	}
+	return assigned, err
+}
+
+// unmarshalField decodes raw into the field val, taking the field specific tags into account.
+func unmarshalField(options *Options, fi *fieldInfo, raw json.RawMessage, val reflect.Value) error {
+	if string(raw) == "null" {
+		// null resets the field like encoding/json does
+		val.Set(reflect.Zero(val.Type()))
+		return nil
+	}
+
+	if fi.rawJSON && val.Kind() == reflect.String {
+		val.SetString(string(raw))
+		return nil
+	}
+
+	if fi.quoted {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return err
+		}
+		// the string holds the JSON encoded value, a string being quoted twice
+		raw = json.RawMessage(s)
+	}
+
+	t := indirectType(val.Type())
+	if t.Kind() == reflect.Struct && !implementsUnmarshaler(t) {
+		return unmarshalStruct(options, raw, allocate(val))
+	}
+	if t.Kind() == reflect.Map && len(options.state.deniedKeys) > 0 && !implementsUnmarshaler(t) {
+		var err error
+		if raw, err = dropDeniedKeys(options, raw); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(raw, val.Addr().Interface())
+}
+
+// dropDeniedKeys removes the keys of the JSON object raw which Marshal would have omitted
+// because of options.GroupKeyDeny.
+func dropDeniedKeys(options *Options, raw json.RawMessage) (json.RawMessage, error) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, err
+	}
+	for key := range object {
+		if isKeyDenied(options, key) {
+			delete(object, key)
+		}
+	}
+	return json.Marshal(object)
+}
+
+// indirectType returns the type t points to, or t if it isn't a pointer.
+func indirectType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// allocate returns the struct val or the struct val points to, allocating it if the pointer is nil.
+func allocate(val reflect.Value) reflect.Value {
+	if val.Kind() != reflect.Ptr {
+		return val
+	}
+	if val.IsNil() {
+		val.Set(reflect.New(val.Type().Elem()))
+	}
+	return val.Elem()
+}
+
+// implementsUnmarshaler checks whether values of type t decode themselves, e.g. time.Time.
+func implementsUnmarshaler(t reflect.Type) bool {
+	p := reflect.PointerTo(t)
+	return p.Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) ||
+		p.Implements(reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem())
+}
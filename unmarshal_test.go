@@ -0,0 +1,178 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/hashicorp/go-version"
+	"github.com/stretchr/testify/assert"
+)
+
+type UnmarshalAddress struct {
+	Street string `json:"street" groups:"api"`
+	Notes  string `json:"notes" groups:"admin"`
+}
+
+type UnmarshalBase struct {
+	ID int `json:"id" groups:"api"`
+}
+
+type UnmarshalUser struct {
+	UnmarshalBase
+	Name     string            `json:"name" groups:"api"`
+	Email    string            `json:"email" groups:"admin"`
+	Count    int               `json:"count,string" groups:"api"`
+	Address  *UnmarshalAddress `json:"address" groups:"api"`
+	Tags     []string          `json:"tags" groups:"api"`
+	Settings string            `json:"settings" groups:"api" rawjson:"true"`
+	Legacy   string            `json:"legacy" groups:"api" until:"1"`
+	Hidden   string            `json:"-"`
+}
+
+func TestUnmarshal_RoundTrip(t *testing.T) {
+	v1, err := version.NewVersion("2")
+	assert.NoError(t, err)
+	o := &Options{Groups: []string{"api"}, ApiVersion: v1}
+
+	original := UnmarshalUser{
+		UnmarshalBase: UnmarshalBase{ID: 7},
+		Name:          "alice",
+		Email:         "alice@example.com",
+		Count:         3,
+		Address:       &UnmarshalAddress{Street: "Main", Notes: "notes"},
+		Tags:          []string{"a", "b"},
+		Settings:      `{"theme":"dark"}`,
+		Legacy:        "legacy",
+		Hidden:        "hidden",
+	}
+	data, err := MarshalToJSON(o, original)
+	assert.NoError(t, err)
+
+	dest := UnmarshalUser{
+		Name:    "old",
+		Email:   "bob@example.com",
+		Address: &UnmarshalAddress{Street: "Old", Notes: "kept"},
+		Legacy:  "kept",
+		Hidden:  "kept",
+	}
+	assert.NoError(t, Unmarshal(o, data, &dest))
+
+	expected := UnmarshalUser{
+		UnmarshalBase: UnmarshalBase{ID: 7},
+		Name:          "alice",
+		Email:         "bob@example.com",
+		Count:         3,
+		Address:       &UnmarshalAddress{Street: "Main", Notes: "kept"},
+		Tags:          []string{"a", "b"},
+		Settings:      `{"theme":"dark"}`,
+		Legacy:        "kept",
+		Hidden:        "kept",
+	}
+	assert.Equal(t, expected, dest)
+}
+
+func TestUnmarshal_IgnoresFieldsOutsideGroups(t *testing.T) {
+	data := []byte(`{"id":1,"name":"alice","email":"alice@example.com","address":{"street":"Main","notes":"notes"}}`)
+
+	v1, err := version.NewVersion("1")
+	assert.NoError(t, err)
+
+	var dest UnmarshalUser
+	assert.NoError(t, Unmarshal(&Options{Groups: []string{"api"}, ApiVersion: v1}, data, &dest))
+	assert.Equal(t, UnmarshalUser{
+		UnmarshalBase: UnmarshalBase{ID: 1},
+		Name:          "alice",
+		Address:       &UnmarshalAddress{Street: "Main"},
+	}, dest)
+}
+
+func TestUnmarshal_EmbeddedPointer(t *testing.T) {
+	type embeddingModel struct {
+		*UnmarshalAddress
+		Name string `json:"name" groups:"api"`
+	}
+	o := &Options{Groups: []string{"api"}}
+
+	// the embedded struct is only allocated if one of its fields is assigned
+	var dest embeddingModel
+	assert.NoError(t, Unmarshal(o, []byte(`{"name":"x"}`), &dest))
+	assert.Equal(t, embeddingModel{Name: "x"}, dest)
+
+	dest = embeddingModel{}
+	assert.NoError(t, Unmarshal(o, []byte(`{"name":"x","notes":"filtered"}`), &dest))
+	assert.Equal(t, embeddingModel{Name: "x"}, dest)
+
+	dest = embeddingModel{}
+	assert.NoError(t, Unmarshal(o, []byte(`{"name":"x","street":"Main"}`), &dest))
+	assert.Equal(t, embeddingModel{UnmarshalAddress: &UnmarshalAddress{Street: "Main"}, Name: "x"}, dest)
+}
+
+func TestUnmarshal_InheritFieldGroups(t *testing.T) {
+	type profile struct {
+		Bio    string `json:"bio"`
+		Secret string `json:"secret" groups:"admin"`
+	}
+	type inheritingModel struct {
+		Profile profile `json:"profile" groups:"api,inherit"`
+		Other   profile `json:"other" groups:"api"`
+	}
+	original := inheritingModel{Profile: profile{"bio", "secret"}, Other: profile{"other", "secret"}}
+
+	tests := []struct {
+		options  *Options
+		expected inheritingModel
+	}{
+		{&Options{Groups: []string{"api"}}, inheritingModel{Profile: profile{Bio: "bio"}}},
+		{&Options{Groups: []string{"api"}, InheritFieldGroups: true}, inheritingModel{Profile: profile{Bio: "bio"}, Other: profile{Bio: "other"}}},
+	}
+
+	for _, test := range tests {
+		data, err := MarshalToJSON(test.options, original)
+		assert.NoError(t, err)
+
+		var dest inheritingModel
+		assert.NoError(t, Unmarshal(test.options, data, &dest))
+		assert.Equal(t, test.expected, dest, "json %s", data)
+
+		// fields Marshal wouldn't emit aren't assigned either
+		dest = inheritingModel{}
+		assert.NoError(t, Unmarshal(test.options, []byte(`{"profile":{"bio":"bio","secret":"s"},"other":{"bio":"other","secret":"s"}}`), &dest))
+		assert.Equal(t, test.expected, dest)
+	}
+}
+
+func TestUnmarshal_GroupKeyDeny(t *testing.T) {
+	type deniedModel struct {
+		Name    string            `json:"name" groups:"public"`
+		IsAdmin bool              `json:"is_admin" groups:"public"`
+		Meta    map[string]string `json:"meta" groups:"public"`
+	}
+	o := &Options{Groups: []string{"public"}, GroupKeyDeny: map[string][]string{"public": {"is_*"}}}
+
+	original := deniedModel{Name: "alice", IsAdmin: true, Meta: map[string]string{"lang": "de", "is_staff": "true"}}
+	data, err := MarshalToJSON(o, original)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"meta":{"lang":"de"},"name":"alice"}`, string(data))
+
+	var dest deniedModel
+	assert.NoError(t, Unmarshal(o, data, &dest))
+	assert.Equal(t, deniedModel{Name: "alice", Meta: map[string]string{"lang": "de"}}, dest)
+
+	// denied keys can't be mass-assigned
+	dest = deniedModel{}
+	assert.NoError(t, Unmarshal(o, []byte(`{"name":"mallory","is_admin":true,"meta":{"lang":"en","is_staff":"true"}}`), &dest))
+	assert.Equal(t, deniedModel{Name: "mallory", Meta: map[string]string{"lang": "en"}}, dest)
+}
+
+func TestUnmarshal_Errors(t *testing.T) {
+	var dest UnmarshalUser
+	assert.EqualError(t, Unmarshal(&Options{}, []byte(`{}`), dest), "sheriff: Unmarshal requires a non-nil pointer to a struct")
+
+	err := Unmarshal(&Options{Groups: []string{"api"}}, []byte(`{"address":{"street":1}}`), &dest)
+	var fieldErr *MarshalFieldError
+	assert.ErrorAs(t, err, &fieldErr)
+	assert.Equal(t, "address.street", fieldErr.Path)
+
+	var syntaxErr *json.SyntaxError
+	assert.ErrorAs(t, Unmarshal(&Options{}, []byte(`{`), &dest), &syntaxErr)
+}
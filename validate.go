@@ -0,0 +1,87 @@
+package sheriff
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hashicorp/go-version"
+)
+
+// Validate walks the type of the passed prototype and checks the sheriff tags of every field.
+// It returns a combined error listing every field with an unparseable `since` or `until` version, an unparseable
+// `version` constraint or an empty or malformed `groups` token, or nil if all tags are valid.
+//
+// Validate only inspects the type, it's therefore well suited to be called from a unit test in order to catch tagging
+// mistakes before they reach production. It uses the default tag names, see ValidateWithOptions.
+func Validate(prototype interface{}) error {
+	return ValidateWithOptions(&Options{}, prototype)
+}
+
+// ValidateWithOptions is like Validate but reads the tags configured by Options.GroupName, Options.SinceName and
+// Options.UntilName, for models using custom tag names.
+func ValidateWithOptions(options *Options, prototype interface{}) error {
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		return nil
+	}
+
+	var errs []error
+	validateType(t, t.Name(), options.tagNames(), map[reflect.Type]bool{}, &errs)
+
+	return errors.Join(errs...)
+}
+
+// validateType recursively validates the tags of the struct fields reachable from t.
+// Already visited types are skipped in order to support recursive types.
+func validateType(t reflect.Type, path string, names tagNames, visited map[reflect.Type]bool, errs *[]error) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || visited[t] {
+		return
+	}
+	visited[t] = true
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldPath := field.Name
+		if path != "" {
+			fieldPath = path + "." + field.Name
+		}
+
+		for _, tag := range []string{names.since, names.until} {
+			if v, ok := field.Tag.Lookup(tag); ok {
+				if _, err := version.NewVersion(v); err != nil {
+					*errs = append(*errs, fmt.Errorf("sheriff: field %s: invalid %s version %q: %w", fieldPath, tag, v, err))
+				}
+			}
+		}
+
+		if v, ok := field.Tag.Lookup("version"); ok {
+			if _, err := version.NewConstraint(v); err != nil {
+				*errs = append(*errs, fmt.Errorf("sheriff: field %s: invalid version constraint %q: %w", fieldPath, v, err))
+			}
+		}
+
+		if groups, ok := field.Tag.Lookup(names.groups); ok {
+			tokens := strings.Split(groups, ",")
+			if modifier, _, ok := strings.Cut(tokens[0], ":"); ok && strings.HasPrefix(modifier, minGroupsPrefix) {
+				if n, err := strconv.Atoi(strings.TrimPrefix(modifier, minGroupsPrefix)); err != nil || n < 1 {
+					*errs = append(*errs, fmt.Errorf("sheriff: field %s: malformed groups modifier %q in %q", fieldPath, modifier, groups))
+				}
+			}
+			tokens, _ = parseGroupsModifier(tokens)
+			for _, group := range tokens {
+				if group == "" || strings.IndexFunc(group, unicode.IsSpace) >= 0 {
+					*errs = append(*errs, fmt.Errorf("sheriff: field %s: malformed groups token %q in %q", fieldPath, group, groups))
+				}
+			}
+		}
+
+		validateType(field.Type, fieldPath, names, visited, errs)
+	}
+}
@@ -0,0 +1,77 @@
+package sheriff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ValidAddress struct {
+	Street string `json:"street" groups:"personal" since:"1.2"`
+}
+
+type ValidModel struct {
+	Username string          `json:"username" groups:"api,personal"`
+	Quorum   string          `json:"quorum" groups:"min2:api,personal,admin"`
+	Address  *ValidAddress   `json:"address" groups:"personal" until:"3"`
+	Friends  []*ValidModel   `json:"friends" groups:"api" version:">= 1.2, < 2.0"`
+	Settings map[string]bool `json:"settings"`
+}
+
+type InvalidAddress struct {
+	Street string `json:"street" groups:"personal," since:"one"`
+}
+
+type InvalidModel struct {
+	Username string            `json:"username" groups:"api,,personal"`
+	Email    string            `json:"email" groups:"api, personal"`
+	Quorum   string            `json:"quorum" groups:"minx:a,b"`
+	Role     string            `json:"role" until:"x.y.z"`
+	Legacy   string            `json:"legacy" version:">= one"`
+	Address  InvalidAddress    `json:"address"`
+	Extra    []*InvalidAddress `json:"extra"`
+}
+
+func TestValidate_Valid(t *testing.T) {
+	assert.NoError(t, Validate(ValidModel{}))
+	assert.NoError(t, Validate(&ValidModel{}))
+	assert.NoError(t, Validate(nil))
+}
+
+func TestValidate_Invalid(t *testing.T) {
+	err := Validate(InvalidModel{})
+	assert.Error(t, err)
+
+	msg := err.Error()
+	assert.Contains(t, msg, `field InvalidModel.Username: malformed groups token "" in "api,,personal"`)
+	assert.Contains(t, msg, `field InvalidModel.Email: malformed groups token " personal" in "api, personal"`)
+	assert.Contains(t, msg, `field InvalidModel.Quorum: malformed groups modifier "minx" in "minx:a,b"`)
+	assert.Contains(t, msg, `field InvalidModel.Role: invalid until version "x.y.z"`)
+	assert.Contains(t, msg, `field InvalidModel.Legacy: invalid version constraint ">= one"`)
+	assert.Contains(t, msg, `field InvalidModel.Address.Street: invalid since version "one"`)
+	assert.Contains(t, msg, `field InvalidModel.Address.Street: malformed groups token "" in "personal,"`)
+	// InvalidAddress has already been validated via the Address field
+	assert.NotContains(t, msg, "InvalidModel.Extra.Street")
+}
+
+func TestValidateWithOptions(t *testing.T) {
+	type customTagsModel struct {
+		Name  string `json:"name" roles:"api,,admin"`
+		Since string `json:"since" from:"one"`
+		Until string `json:"until" to:"x.y.z"`
+		// the default tags aren't read if custom names are configured
+		Ignored string `json:"ignored" groups:"api,,admin" since:"one"`
+	}
+	o := &Options{GroupName: "roles", SinceName: "from", UntilName: "to"}
+
+	err := ValidateWithOptions(o, customTagsModel{})
+	assert.Error(t, err)
+
+	msg := err.Error()
+	assert.Contains(t, msg, `field customTagsModel.Name: malformed groups token "" in "api,,admin"`)
+	assert.Contains(t, msg, `field customTagsModel.Since: invalid from version "one"`)
+	assert.Contains(t, msg, `field customTagsModel.Until: invalid to version "x.y.z"`)
+	assert.NotContains(t, msg, "customTagsModel.Ignored")
+
+	assert.NoError(t, ValidateWithOptions(o, ValidModel{}))
+}
@@ -0,0 +1,111 @@
+package sheriff
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+)
+
+// MarshalToValue marshals the passed data using Marshal and converts the result into a generic tree which can be
+// consumed by other encoders, e.g. for YAML, msgpack or BSON.
+//
+// The tree only consists of map[string]interface{} for objects, []interface{} for arrays and booleans, strings,
+// numbers and nil for the leaves, independent of the Options.KVStoreFactory. Leaves which aren't JSON primitives,
+// e.g. values implementing json.Marshaler, are replaced by the result of their JSON encoding, which keeps the tree
+// equivalent to the JSON output. Maps don't keep the order of their keys.
+func MarshalToValue(options *Options, data interface{}) (interface{}, error) {
+	v, err := Marshal(options, data)
+	if err != nil {
+		return nil, err
+	}
+	return toValue(v)
+}
+
+// toValue converts the output of Marshal into the generic tree described by MarshalToValue.
+func toValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case json.Number:
+		return numbersToValue(v), nil
+	case nil, bool, string,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return v, nil
+	case KVStore:
+		m := make(map[string]interface{})
+		var err error
+		v.Each(func(k string, value interface{}) {
+			if err != nil {
+				return
+			}
+			if m[k], err = toValue(value); err != nil {
+				err = wrapFieldError(err, k)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, value := range v {
+			var err error
+			if s[i], err = toValue(value); err != nil {
+				return nil, wrapFieldError(err, "["+strconv.Itoa(i)+"]")
+			}
+		}
+		return s, nil
+	}
+
+	// named types of primitive kinds are converted to the primitive types,
+	// unless they are encoded by their own MarshalJSON or MarshalText method
+	rv := reflect.ValueOf(v)
+	if !rv.Type().Implements(jsonMarshalerType) && !rv.Type().Implements(textMarshalerType) {
+		switch rv.Kind() {
+		case reflect.Bool:
+			return rv.Bool(), nil
+		case reflect.String:
+			return rv.String(), nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int(), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			return rv.Uint(), nil
+		case reflect.Float32, reflect.Float64:
+			return rv.Float(), nil
+		}
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var decoded interface{}
+	if err := dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return numbersToValue(decoded), nil
+}
+
+// numbersToValue replaces the json.Number values of a decoded JSON tree by int64 or float64.
+func numbersToValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, value := range v {
+			v[k] = numbersToValue(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = numbersToValue(value)
+		}
+	}
+	return v
+}
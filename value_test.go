@@ -0,0 +1,113 @@
+package sheriff
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+type ValueStatus string
+
+type ValueState int
+
+func (s ValueState) MarshalJSON() ([]byte, error) {
+	return []byte(`"active"`), nil
+}
+
+type ValueLabel string
+
+func (l ValueLabel) MarshalText() ([]byte, error) {
+	return []byte("L-" + string(l)), nil
+}
+
+type ValueModel struct {
+	Name    string            `json:"name" groups:"api"`
+	Secret  string            `json:"secret" groups:"admin"`
+	Status  ValueStatus       `json:"status" groups:"api"`
+	Labels  map[string]string `json:"labels" groups:"api"`
+	Tags    []string          `json:"tags" groups:"api"`
+	IP      net.IP            `json:"ip" groups:"api"`
+	Created time.Time         `json:"created" groups:"api"`
+	Count   json.Number       `json:"count" groups:"api"`
+}
+
+func TestMarshalToValue(t *testing.T) {
+	v := ValueModel{
+		Name:    "alice",
+		Secret:  "secret",
+		Status:  "active",
+		Labels:  map[string]string{"team": "core"},
+		Tags:    []string{"a", "b"},
+		IP:      net.ParseIP("127.0.0.1"),
+		Created: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Count:   "42",
+	}
+
+	for _, o := range []*Options{
+		{Groups: []string{"api"}},
+		{Groups: []string{"api"}, KVStoreFactory: NewOrderedKVStore},
+	} {
+		actual, err := MarshalToValue(o, v)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{
+			"name":    "alice",
+			"status":  "active",
+			"labels":  map[string]interface{}{"team": "core"},
+			"tags":    []interface{}{"a", "b"},
+			"ip":      "127.0.0.1",
+			"created": "2024-01-02T03:04:05Z",
+			"count":   int64(42),
+		}, actual)
+
+		out, err := yaml.Marshal(actual)
+		assert.NoError(t, err)
+		assert.Equal(t, `count: 42
+created: "2024-01-02T03:04:05Z"
+ip: 127.0.0.1
+labels:
+    team: core
+name: alice
+status: active
+tags:
+    - a
+    - b
+`, string(out))
+	}
+}
+
+func TestMarshalToValue_Slice(t *testing.T) {
+	actual, err := MarshalToValue(&Options{Groups: []string{"api"}}, []ValueModel{{Name: "alice"}})
+	assert.NoError(t, err)
+
+	s, ok := actual.([]interface{})
+	assert.True(t, ok)
+	m, ok := s[0].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, "alice", m["name"])
+	assert.Nil(t, m["labels"])
+	// like in the JSON output, a nil net.IP results in an empty string
+	assert.Equal(t, "", m["ip"])
+}
+
+func TestMarshalToValue_SelfMarshallingPrimitives(t *testing.T) {
+	type testStruct struct {
+		State ValueState `json:"s"`
+		Label ValueLabel `json:"l"`
+	}
+	v := testStruct{State: 1, Label: "x"}
+
+	actual, err := MarshalToValue(&Options{}, v)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"s": "active", "l": "L-x"}, actual)
+
+	// the tree is equivalent to the JSON output
+	expected, err := json.Marshal(v)
+	assert.NoError(t, err)
+	out, err := json.Marshal(actual)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(out))
+}
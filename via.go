@@ -0,0 +1,44 @@
+package sheriff
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var (
+	optionsType = reflect.TypeOf((*Options)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// marshalVia marshals the field using the method of the parent struct named in its `via` tag.
+// The method needs the signature func(value T, options *Options) (interface{}, error) with T being the field type.
+// Its result is marshalled using the options, like the results of computed fields.
+func marshalVia(options *Options, parent reflect.Value, fi *fieldInfo, val reflect.Value) (interface{}, error) {
+	method := parent.MethodByName(fi.via)
+	if !method.IsValid() {
+		// methods with a pointer receiver need an addressable parent, which a copy provides
+		addressable := parent
+		if !addressable.CanAddr() {
+			addressable = reflect.New(parent.Type()).Elem()
+			addressable.Set(parent)
+		}
+		method = addressable.Addr().MethodByName(fi.via)
+	}
+	if !method.IsValid() {
+		return nil, fmt.Errorf("marshaller: via method %s not found on %s", fi.via, parent.Type())
+	}
+
+	mt := method.Type()
+	if mt.NumIn() != 2 || !fi.field.Type.AssignableTo(mt.In(0)) || mt.In(1) != optionsType ||
+		mt.NumOut() != 2 || mt.Out(1) != errorType {
+		return nil, fmt.Errorf("marshaller: via method %s.%s has signature %s, expected func(%s, *sheriff.Options) (interface{}, error)",
+			parent.Type(), fi.via, mt, fi.field.Type)
+	}
+
+	out := method.Call([]reflect.Value{val, reflect.ValueOf(options)})
+	if err, _ := out[1].Interface().(error); err != nil {
+		return nil, err
+	}
+	// the result is marshalled like any other value, e.g. in order to filter the fields of a returned struct
+	return marshalValue(options, reflect.ValueOf(out[0].Interface()))
+}